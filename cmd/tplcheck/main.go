@@ -0,0 +1,195 @@
+// Command tplcheck lints every template of a template directory.
+//
+// It reads the yaml config used by template.InitConfig, parses the templates
+// with the configured extension under TplDir and reports the funcs, filters
+// and macros which don't exist, the extended or included templates which
+// can't be loaded, duplicate or unknown blocks and unused variables.
+//
+// Usage:
+//
+//	tplcheck [-config config.yaml] [-json] [-funcs a,b] [-filters c,d]
+//
+// The exit code is 1 if a problem is found, 2 if the check can't be run.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"fbnoi.com/template"
+)
+
+type frame struct {
+	Via    string `json:"via"`
+	Name   string `json:"name"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+type problem struct {
+	Template string  `json:"template"` // template being checked
+	Code     string  `json:"code"`
+	Name     string  `json:"name"` // template the problem is in
+	Line     int     `json:"line"`
+	Column   int     `json:"column"`
+	Message  string  `json:"message"`
+	Snippet  string  `json:"snippet,omitempty"`
+	Chain    []frame `json:"chain,omitempty"`
+}
+
+func main() {
+	var (
+		configPath = flag.String("config", "config.yaml", "path of the yaml config")
+		asJSON     = flag.Bool("json", false, "report problems as json")
+		funcs      = flag.String("funcs", "", "comma separated names of the funcs registered by the application")
+		filters    = flag.String("filters", "", "comma separated names of the filters registered by the application")
+	)
+	flag.Parse()
+
+	problems, err := check(*configPath, split(*funcs), split(*filters))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tplcheck:", err)
+		os.Exit(2)
+	}
+	if *asJSON {
+		err = reportJSON(os.Stdout, problems)
+	} else {
+		err = report(os.Stdout, problems)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tplcheck:", err)
+		os.Exit(2)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// check lints all the templates of the config, problems found in a template
+// shared by several ones are reported once.
+func check(configPath string, funcs, filters []string) ([]*problem, error) {
+	config, err := template.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	engine := template.NewEngine(config)
+	for _, name := range funcs {
+		if err = engine.RegisterFunc(name, func(...any) any { return nil }); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range filters {
+		if err = engine.RegisterFilter(name, func(any, ...any) any { return nil }); err != nil {
+			return nil, err
+		}
+	}
+	names, err := engine.Templates()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var (
+		problems []*problem
+		seen     = make(map[string]bool)
+	)
+	for _, name := range names {
+		for _, p := range problemsOf(name, engine.Lint(name)) {
+			key := fmt.Sprintf("%s:%s:%d:%d:%s", p.Code, p.Name, p.Line, p.Column, p.Message)
+			if !seen[key] {
+				seen[key] = true
+				problems = append(problems, p)
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+func problemsOf(name string, err error) (problems []*problem) {
+	if err == nil {
+		return nil
+	}
+	errs, ok := err.(template.ErrorList)
+	if !ok {
+		errs = template.ErrorList{err}
+	}
+	for _, err := range errs {
+		p := &problem{Template: name, Name: name, Message: err.Error()}
+		var e template.Error
+		if errors.As(err, &e) {
+			loc := e.Where()
+			p.Code = string(e.ErrorCode())
+			p.Line, p.Column, p.Snippet = loc.Line, loc.Column, loc.Snippet()
+			if loc.Line > 0 {
+				p.Name = loc.Name
+			}
+			for _, f := range loc.Chain {
+				p.Chain = append(p.Chain, frame{Via: f.Via, Name: f.Name, Line: f.Line, Column: f.Column})
+			}
+		}
+		problems = append(problems, p)
+	}
+
+	return
+}
+
+func report(w io.Writer, problems []*problem) error {
+	templates := make(map[string]bool)
+	for _, p := range problems {
+		templates[p.Name] = true
+		code := p.Code
+		if code == "" {
+			code = "error"
+		}
+		fmt.Fprintf(w, "%s [%s]\n", p.Message, code)
+		if p.Snippet != "" {
+			fmt.Fprintln(w, indent(p.Snippet))
+		}
+	}
+	if len(problems) == 0 {
+		_, err := fmt.Fprintln(w, "no problems found")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d problem(s) found in %d template(s)\n", len(problems), len(templates))
+
+	return err
+}
+
+func reportJSON(w io.Writer, problems []*problem) error {
+	if problems == nil {
+		problems = []*problem{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+
+	return enc.Encode(problems)
+}
+
+func indent(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = "    " + line
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func split(names string) []string {
+	var list []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			list = append(list, name)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,200 @@
+// Command tplrender renders a template with data read from a json or yaml
+// file.
+//
+// Usage:
+//
+//	tplrender [-config config.yaml | -dir dir] [-data data.yaml] [-set key=value]... [-o out] [template]
+//
+// The template is a file path, it's read from stdin if omitted or "-".
+// Extended and included templates are looked up in the directory of the
+// template, or in -dir. With -config the template is a name under the TplDir
+// of the config instead. Values of -set are parsed as yaml scalars, dotted
+// keys set nested values, e.g. -set server.port=8080.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	v2 "gopkg.in/yaml.v2"
+
+	"fbnoi.com/template"
+)
+
+// sets collects the repeated -set flags.
+type sets []string
+
+func (s *sets) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *sets) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return errors.Errorf("%q isn't of the form key=value", v)
+	}
+	*s = append(*s, v)
+
+	return nil
+}
+
+func main() {
+	var (
+		configPath = flag.String("config", "", "path of the yaml config, templates are named under its TplDir")
+		dir        = flag.String("dir", "", "directory extended and included templates are read from")
+		dataPath   = flag.String("data", "", "json or yaml file of the params")
+		output     = flag.String("o", "", "file the output is written to; stdout by default")
+		overrides  sets
+	)
+	flag.Var(&overrides, "set", "key=value overriding a param, may be repeated")
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*configPath, *dir, *dataPath, *output, flag.Arg(0), overrides); err != nil {
+		fmt.Fprintln(os.Stderr, "tplrender:", err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath, dir, dataPath, output, name string, overrides []string) (err error) {
+	params := make(template.Params)
+	if dataPath != "" {
+		if params, err = loadData(dataPath); err != nil {
+			return err
+		}
+	}
+	for _, kv := range overrides {
+		if err = set(params, kv); err != nil {
+			return err
+		}
+	}
+
+	var engine *template.Engine
+	if configPath != "" {
+		config, err := template.LoadConfig(configPath)
+		if err != nil {
+			return err
+		}
+		engine = template.NewEngine(config)
+	} else {
+		engine = template.NewEngine(nil)
+		if dir == "" && name != "" && name != "-" {
+			dir = filepath.Dir(name)
+		}
+		if dir == "" {
+			dir = "."
+		}
+		engine.SetLoader(template.NewDirLoader(dir))
+		if name != "" && name != "-" {
+			if name, err = filepath.Rel(dir, name); err != nil {
+				return err
+			}
+			name = filepath.ToSlash(name)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		var f *os.File
+		if f, err = os.Create(output); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+	if name == "" || name == "-" {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		return engine.RenderView(string(src), w, params)
+	}
+
+	return engine.Render(name, w, params)
+}
+
+// loadData reads the params from a json file, or a yaml one for other
+// extensions.
+func loadData(path string) (template.Params, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &v)
+	} else {
+		err = v2.Unmarshal(data, &v)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't parse %s", path)
+	}
+	params, ok := normalize(v).(map[string]any)
+	if !ok {
+		return nil, errors.Errorf("%s doesn't hold a mapping", path)
+	}
+
+	return params, nil
+}
+
+// set applies the override key=value to params.
+func set(params template.Params, kv string) error {
+	i := strings.Index(kv, "=")
+	key, raw := kv[:i], kv[i+1:]
+	var value any
+	if err := v2.Unmarshal([]byte(raw), &value); err != nil || value == nil {
+		value = raw
+	}
+	value = normalize(value)
+	keys := strings.Split(key, ".")
+	m := map[string]any(params)
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			m[k] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = value
+
+	return nil
+}
+
+// normalize converts the maps decoded by yaml, which are keyed by any, to
+// maps keyed by string.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, x := range v {
+			m[fmt.Sprint(k)] = normalize(x)
+		}
+		return m
+	case map[string]any:
+		for k, x := range v {
+			v[k] = normalize(x)
+		}
+		return v
+	case []any:
+		for i, x := range v {
+			v[i] = normalize(x)
+		}
+		return v
+	}
+
+	return v
+}
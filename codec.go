@@ -0,0 +1,685 @@
+package template
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	cache_magic = "TPLC"
+	// cache_version is bumped whenever the encoding of documents changes,
+	// caches of other versions are rejected.
+	cache_version = 6
+)
+
+// node tags of the encoded AST
+const (
+	tag_nil = iota
+	tag_ident
+	tag_basic_lit
+	tag_list_expr
+	tag_index_expr
+	tag_call_expr
+	tag_binary_expr
+	tag_single_expr
+	tag_pipeline_expr
+	tag_text_direct
+	tag_value_direct
+	tag_assign_direct
+	tag_section_direct
+	tag_if_direct
+	tag_for_direct
+	tag_block_direct
+	tag_include_direct
+	tag_autoescape_direct
+	tag_macro_direct
+	tag_import_direct
+	tag_from_direct
+	tag_break_direct
+	tag_continue_direct
+)
+
+// SaveCache writes the documents compiled by the engine to w, so that a
+// later LoadCache can skip parsing them.
+func (e *Engine) SaveCache(w io.Writer) error {
+	e.cache.locker.RLock()
+	identities := make([]string, 0, len(e.cache.cache))
+	for identity := range e.cache.cache {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+	docs := make([]*Document, len(identities))
+	for i, identity := range identities {
+		docs[i] = e.cache.cache[identity]
+	}
+	e.cache.locker.RUnlock()
+
+	enc := &encoder{w: bufio.NewWriter(w)}
+	enc.w.WriteString(cache_magic)
+	enc.uint(cache_version)
+	enc.uint(e.whitespace())
+	enc.uint(uint64(len(docs)))
+	for i, doc := range docs {
+		enc.string(identities[i])
+		enc.document(doc)
+	}
+	if enc.err != nil {
+		return enc.err
+	}
+
+	return enc.w.Flush()
+}
+
+// LoadCache reads documents written by SaveCache into the engine. Documents
+// whose source, or the source of a document they extend or include, doesn't
+// match the hash it was compiled from are skipped and built on demand.
+func (e *Engine) LoadCache(r io.Reader) error {
+	dec := &decoder{r: bufio.NewReader(r), engine: e}
+	magic := make([]byte, len(cache_magic))
+	if _, err := io.ReadFull(dec.r, magic); err != nil || string(magic) != cache_magic {
+		return errors.New("template: not a template cache")
+	}
+	if version := dec.uint(); version != cache_version {
+		return errors.Errorf("template: cache version %d isn't supported, want %d", version, cache_version)
+	}
+	if dec.uint() != e.whitespace() {
+		// the documents are trimmed differently, they're built on demand
+		return dec.err
+	}
+	entries := make(map[string]*cacheEntry)
+	for n := dec.uint(); n > 0 && dec.err == nil; n-- {
+		identity := dec.string()
+		dec.refs = nil
+		doc := dec.document()
+		entries[identity] = &cacheEntry{doc: doc, source: dec.source, refs: dec.refs}
+	}
+	if dec.err != nil {
+		return errors.Wrap(dec.err, "template: corrupted cache")
+	}
+
+	checked := make(map[string]bool)
+	for identity := range entries {
+		e.validEntry(identity, entries, checked)
+	}
+	for identity, entry := range entries {
+		if !checked[identity] {
+			continue
+		}
+		for _, ref := range entry.refs {
+			ref.link(entries[ref.name].doc)
+			entry.doc.uses[ref.name] = entries[ref.name].doc
+		}
+		e.cache.setDoc(identity, entry.doc)
+	}
+
+	return nil
+}
+
+// whitespace returns the bits of the whitespace options the documents are
+// tokenized with.
+func (e *Engine) whitespace() uint64 {
+	var bits uint64
+	if e.config != nil && e.config.TrimBlocks {
+		bits |= 1
+	}
+	if e.config != nil && e.config.LstripBlocks {
+		bits |= 2
+	}
+
+	return bits
+}
+
+type cacheEntry struct {
+	doc    *Document
+	source *sourceCode // source the tokens of doc refer to
+	refs   []*docRef
+}
+
+// docRef is a reference to a document by name, which is linked once all
+// the documents of a cache are decoded.
+type docRef struct {
+	name string
+	link func(doc *Document)
+}
+
+// validEntry reports whether the entry of identity matches its source, and
+// the entries it refers to are valid too.
+func (e *Engine) validEntry(identity string, entries map[string]*cacheEntry, checked map[string]bool) bool {
+	if valid, ok := checked[identity]; ok {
+		return valid
+	}
+	checked[identity] = false
+	entry, ok := entries[identity]
+	if !ok {
+		return false
+	}
+	if entry.doc.name != "" {
+		code, err := e.getLoader().Load(entry.doc.name)
+		if err != nil || abstract([]byte(code)) != entry.doc.hash {
+			return false
+		}
+		entry.source.code = code
+	}
+	for _, ref := range entry.refs {
+		if !e.validEntry(ref.name, entries, checked) {
+			return false
+		}
+	}
+	checked[identity] = true
+
+	return true
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (enc *encoder) uint(n uint64) {
+	if enc.err == nil {
+		_, enc.err = enc.w.Write(enc.buf[:binary.PutUvarint(enc.buf[:], n)])
+	}
+}
+
+func (enc *encoder) int(n int) {
+	if enc.err == nil {
+		_, enc.err = enc.w.Write(enc.buf[:binary.PutVarint(enc.buf[:], int64(n))])
+	}
+}
+
+func (enc *encoder) bool(b bool) {
+	if b {
+		enc.uint(1)
+	} else {
+		enc.uint(0)
+	}
+}
+
+func (enc *encoder) string(s string) {
+	enc.uint(uint64(len(s)))
+	if enc.err == nil {
+		_, enc.err = enc.w.WriteString(s)
+	}
+}
+
+func (enc *encoder) token(tok *token) {
+	if tok == nil {
+		enc.bool(false)
+		return
+	}
+	enc.bool(true)
+	enc.string(tok.value)
+	enc.int(tok.typ)
+	enc.int(tok.line)
+	enc.int(tok.col)
+}
+
+func (enc *encoder) document(doc *Document) {
+	enc.string(doc.name)
+	enc.string(doc.hash)
+	enc.uint(uint64(len(doc.deps)))
+	for _, dep := range doc.deps {
+		enc.string(dep)
+	}
+	if doc.extend != nil {
+		enc.bool(true)
+		enc.token(doc.extend.path.value)
+		enc.string(doc.extend.doc.name)
+	} else {
+		enc.bool(false)
+	}
+	enc.section(doc.body)
+}
+
+func (enc *encoder) section(d *sectionDirect) {
+	if d == nil {
+		enc.bool(false)
+		return
+	}
+	enc.bool(true)
+	enc.uint(uint64(len(d.list)))
+	for _, x := range d.list {
+		enc.direct(x)
+	}
+}
+
+func (enc *encoder) expr(x expr) {
+	switch x := x.(type) {
+	case nil:
+		enc.uint(tag_nil)
+	case *ident:
+		enc.uint(tag_ident)
+		enc.token(x.name)
+	case *basicLit:
+		enc.uint(tag_basic_lit)
+		enc.int(x.kind)
+		enc.token(x.value)
+	case *listExpr:
+		enc.listExpr(x)
+	case *indexExpr:
+		enc.uint(tag_index_expr)
+		enc.expr(x.x)
+		enc.expr(x.index)
+		enc.token(x.op)
+	case *callExpr:
+		enc.uint(tag_call_expr)
+		enc.token(x.fn.name)
+		enc.listExpr(x.args)
+	case *binaryExpr:
+		enc.uint(tag_binary_expr)
+		enc.expr(x.x)
+		enc.token(x.op)
+		enc.expr(x.y)
+	case *singleExpr:
+		enc.uint(tag_single_expr)
+		enc.expr(x.x)
+		enc.token(x.op)
+	case *pipelineExpr:
+		enc.uint(tag_pipeline_expr)
+		enc.expr(x.x)
+		enc.expr(x.y)
+	default:
+		enc.fail(x)
+	}
+}
+
+func (enc *encoder) listExpr(x *listExpr) {
+	if x == nil {
+		enc.uint(tag_nil)
+		return
+	}
+	enc.uint(tag_list_expr)
+	enc.uint(uint64(len(x.list)))
+	for _, v := range x.list {
+		enc.expr(v)
+	}
+}
+
+func (enc *encoder) direct(x direct) {
+	switch x := x.(type) {
+	case nil:
+		enc.uint(tag_nil)
+	case *textDirect:
+		enc.uint(tag_text_direct)
+		enc.token(x.text.value)
+	case *valueDirect:
+		enc.uint(tag_value_direct)
+		enc.expr(x.tok)
+		enc.uint(uint64(x.esc))
+		enc.bool(x.declared)
+	case *assignDirect:
+		enc.uint(tag_assign_direct)
+		enc.token(x.lh.name)
+		enc.expr(x.rh)
+	case *sectionDirect:
+		enc.uint(tag_section_direct)
+		enc.section(x)
+	case *ifDirect:
+		enc.uint(tag_if_direct)
+		enc.expr(x.cond)
+		enc.section(x.body)
+		enc.direct(x.el)
+	case *forDirect:
+		enc.uint(tag_for_direct)
+		if x.key != nil {
+			enc.token(x.key.name)
+		} else {
+			enc.token(nil)
+		}
+		enc.token(x.value.name)
+		enc.expr(x.x)
+		enc.expr(x.cond)
+		enc.section(x.body)
+		enc.section(x.el)
+	case *blockDirect:
+		enc.uint(tag_block_direct)
+		enc.token(x.name.value)
+		enc.section(x.body)
+	case *includeDirect:
+		enc.uint(tag_include_direct)
+		enc.token(x.path.value)
+		enc.expr(x.params)
+		enc.bool(x.only)
+		enc.string(x.doc.name)
+	case *autoescapeDirect:
+		enc.uint(tag_autoescape_direct)
+		enc.token(x.strategy)
+		enc.uint(uint64(x.esc))
+		enc.section(x.body)
+	case *macroDirect:
+		enc.uint(tag_macro_direct)
+		enc.token(x.name)
+		enc.uint(uint64(len(x.params)))
+		for i, param := range x.params {
+			enc.token(param.name)
+			enc.expr(x.defaults[i])
+		}
+		enc.section(x.body)
+	case *importDirect:
+		enc.uint(tag_import_direct)
+		enc.token(x.path.value)
+		enc.token(x.alias.name)
+		enc.string(x.doc.name)
+	case *fromDirect:
+		enc.uint(tag_from_direct)
+		enc.token(x.path.value)
+		enc.uint(uint64(len(x.names)))
+		for i, name := range x.names {
+			enc.token(name.name)
+			enc.token(x.aliases[i].name)
+		}
+		enc.string(x.doc.name)
+	case *breakDirect:
+		enc.uint(tag_break_direct)
+		enc.token(x.tok)
+		enc.expr(x.cond)
+	case *continueDirect:
+		enc.uint(tag_continue_direct)
+		enc.token(x.tok)
+		enc.expr(x.cond)
+	default:
+		enc.fail(x)
+	}
+}
+
+func (enc *encoder) fail(x node) {
+	if enc.err == nil {
+		enc.err = errors.Errorf("template: can't encode node %T", x)
+	}
+}
+
+type decoder struct {
+	r      *bufio.Reader
+	err    error
+	engine *Engine
+	doc    *Document   // document being decoded
+	source *sourceCode // source of the document being decoded, its code is set once validated
+	refs   []*docRef   // references of the document being decoded
+}
+
+func (dec *decoder) uint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	var n uint64
+	n, dec.err = binary.ReadUvarint(dec.r)
+
+	return n
+}
+
+func (dec *decoder) int() int {
+	if dec.err != nil {
+		return 0
+	}
+	var n int64
+	n, dec.err = binary.ReadVarint(dec.r)
+
+	return int(n)
+}
+
+func (dec *decoder) bool() bool {
+	return dec.uint() == 1
+}
+
+// count reads the length of a list, which is bounded to keep corrupted
+// caches from allocating huge lists.
+func (dec *decoder) count() int {
+	n := dec.uint()
+	if n > 1<<24 {
+		dec.failf("list of %d items", n)
+		return 0
+	}
+
+	return int(n)
+}
+
+func (dec *decoder) string() string {
+	n := dec.count()
+	if dec.err != nil {
+		return ""
+	}
+	bs := make([]byte, n)
+	_, dec.err = io.ReadFull(dec.r, bs)
+
+	return string(bs)
+}
+
+func (dec *decoder) token() *token {
+	if !dec.bool() {
+		return nil
+	}
+	tok := &token{value: dec.string()}
+	tok.typ = dec.int()
+	tok.line = dec.int()
+	tok.col = dec.int()
+	tok.src = dec.source
+
+	return tok
+}
+
+func (dec *decoder) mustToken() *token {
+	tok := dec.token()
+	if tok == nil {
+		dec.failf("missing token")
+		return &token{}
+	}
+
+	return tok
+}
+
+func (dec *decoder) ref(name string, link func(doc *Document)) {
+	dec.refs = append(dec.refs, &docRef{name: name, link: link})
+}
+
+func (dec *decoder) document() *Document {
+	doc := newDocument(dec.engine, dec.string())
+	dec.doc = doc
+	dec.source = &sourceCode{name: doc.name}
+	doc.hash = dec.string()
+	for n := dec.count(); n > 0 && dec.err == nil; n-- {
+		doc.deps = append(doc.deps, dec.string())
+	}
+	if dec.bool() {
+		extend := &extendDirect{}
+		tok := dec.mustToken()
+		extend.path = &basicLit{kind: tok.typ, value: tok}
+		dec.ref(dec.string(), func(base *Document) {
+			base.extended = true
+			extend.doc = base
+		})
+		doc.extend = extend
+	}
+	doc.body = dec.section()
+
+	return doc
+}
+
+func (dec *decoder) section() *sectionDirect {
+	if !dec.bool() {
+		return nil
+	}
+	d := &sectionDirect{}
+	for n := dec.count(); n > 0 && dec.err == nil; n-- {
+		if x := dec.direct(); x != nil {
+			d.list = append(d.list, x)
+		} else {
+			dec.failf("missing direct")
+		}
+	}
+
+	return d
+}
+
+// body reads the body of a direct, which is empty rather than nil.
+func (dec *decoder) body() *sectionDirect {
+	if d := dec.section(); d != nil {
+		return d
+	}
+
+	return &sectionDirect{}
+}
+
+func (dec *decoder) expr() expr {
+	switch tag := dec.uint(); tag {
+	case tag_nil:
+		return nil
+	case tag_ident:
+		return &ident{name: dec.mustToken()}
+	case tag_basic_lit:
+		kind := dec.int()
+		return &basicLit{kind: kind, value: dec.mustToken()}
+	case tag_list_expr:
+		return dec.listExpr()
+	case tag_index_expr:
+		x := &indexExpr{x: dec.mustExpr(), index: dec.mustExpr()}
+		x.op = dec.mustToken()
+		return x
+	case tag_call_expr:
+		x := &callExpr{fn: &ident{name: dec.mustToken()}}
+		if dec.uint() == tag_list_expr {
+			x.args = dec.listExpr()
+		}
+		return x
+	case tag_binary_expr:
+		x := &binaryExpr{x: dec.mustExpr(), op: dec.mustToken()}
+		x.y = dec.mustExpr()
+		return x
+	case tag_single_expr:
+		x := &singleExpr{x: dec.mustExpr()}
+		x.op = dec.mustToken()
+		return x
+	case tag_pipeline_expr:
+		x := &pipelineExpr{x: dec.mustExpr()}
+		x.y = dec.mustExpr()
+		return x
+	default:
+		dec.failf("unknown expr tag %d", tag)
+		return nil
+	}
+}
+
+// mustExpr reads an expr which can't be nil, such as the operands of a
+// binary expr.
+func (dec *decoder) mustExpr() expr {
+	x := dec.expr()
+	if x == nil {
+		dec.failf("missing expr")
+	}
+
+	return x
+}
+
+// listExpr reads the items of a listExpr whose tag is read already.
+func (dec *decoder) listExpr() *listExpr {
+	x := &listExpr{}
+	for n := dec.count(); n > 0 && dec.err == nil; n-- {
+		x.list = append(x.list, dec.mustExpr())
+	}
+
+	return x
+}
+
+func (dec *decoder) direct() direct {
+	switch tag := dec.uint(); tag {
+	case tag_nil:
+		return nil
+	case tag_text_direct:
+		return &textDirect{text: &basicLit{kind: type_string, value: dec.mustToken()}}
+	case tag_value_direct:
+		d := &valueDirect{tok: dec.mustExpr()}
+		d.esc = escaper(dec.uint())
+		d.declared = dec.bool()
+		return d
+	case tag_assign_direct:
+		d := &assignDirect{lh: &ident{name: dec.mustToken()}}
+		d.rh = dec.mustExpr()
+		return d
+	case tag_section_direct:
+		if d := dec.section(); d != nil {
+			return d
+		}
+		return &sectionDirect{}
+	case tag_if_direct:
+		d := &ifDirect{cond: dec.mustExpr()}
+		d.body = dec.body()
+		d.el = dec.direct()
+		return d
+	case tag_for_direct:
+		d := &forDirect{}
+		if tok := dec.token(); tok != nil {
+			d.key = &ident{name: tok}
+		}
+		d.value = &ident{name: dec.mustToken()}
+		d.x = dec.mustExpr()
+		d.cond = dec.expr()
+		d.body = dec.body()
+		d.el = dec.section()
+		d.loop = refersLoop(d.body)
+		return d
+	case tag_block_direct:
+		d := &blockDirect{name: &basicLit{kind: type_string, value: dec.mustToken()}}
+		d.body = dec.body()
+		dec.doc.blocks[d.name.value.value] = d
+		return d
+	case tag_include_direct:
+		tok := dec.mustToken()
+		d := &includeDirect{path: &basicLit{kind: tok.typ, value: tok}}
+		d.params = dec.expr()
+		d.only = dec.bool()
+		dec.ref(dec.string(), func(doc *Document) {
+			d.doc = doc
+		})
+		return d
+	case tag_autoescape_direct:
+		d := &autoescapeDirect{strategy: dec.mustToken()}
+		d.esc = escaper(dec.uint())
+		d.body = dec.body()
+		return d
+	case tag_macro_direct:
+		d := &macroDirect{name: dec.mustToken(), doc: dec.doc}
+		for n := dec.count(); n > 0 && dec.err == nil; n-- {
+			d.params = append(d.params, &ident{name: dec.mustToken()})
+			d.defaults = append(d.defaults, dec.expr())
+		}
+		d.body = dec.section()
+		dec.doc.macros[d.name.value] = d
+		return d
+	case tag_import_direct:
+		tok := dec.mustToken()
+		d := &importDirect{path: &basicLit{kind: tok.typ, value: tok}}
+		d.alias = &ident{name: dec.mustToken()}
+		dec.ref(dec.string(), func(doc *Document) {
+			d.doc = doc
+		})
+		return d
+	case tag_from_direct:
+		tok := dec.mustToken()
+		d := &fromDirect{path: &basicLit{kind: tok.typ, value: tok}}
+		for n := dec.count(); n > 0 && dec.err == nil; n-- {
+			d.names = append(d.names, &ident{name: dec.mustToken()})
+			d.aliases = append(d.aliases, &ident{name: dec.mustToken()})
+		}
+		dec.ref(dec.string(), func(doc *Document) {
+			d.doc = doc
+		})
+		return d
+	case tag_break_direct:
+		return &breakDirect{tok: dec.mustToken(), cond: dec.expr()}
+	case tag_continue_direct:
+		return &continueDirect{tok: dec.mustToken(), cond: dec.expr()}
+	default:
+		dec.failf("unknown direct tag %d", tag)
+		return nil
+	}
+}
+
+func (dec *decoder) failf(format string, args ...any) {
+	if dec.err == nil {
+		dec.err = errors.Errorf(format, args...)
+	}
+}
@@ -12,19 +12,43 @@ var pwd string
 type Config struct {
 	TplDir  string `yaml:"TplDir"`
 	ExtName string `yaml:"ExtName"`
+	// AutoReload rebuilds templates whose source, or the source of a
+	// template they extend or include, changed since they were built. It's
+	// meant for development, every render reads the sources again.
+	AutoReload bool `yaml:"AutoReload"`
+	// TrimBlocks strips the first newline after a block tag or a comment.
+	TrimBlocks bool `yaml:"TrimBlocks"`
+	// LstripBlocks strips the spaces and tabs from the start of a line to
+	// a block tag or a comment.
+	LstripBlocks bool `yaml:"LstripBlocks"`
 }
 
+// InitConfig loads the yaml config at path, relative to the working
+// directory, into the default engine.
 func InitConfig(path string) (err error) {
 	pwd, err = os.Getwd()
 	if err != nil {
 		return err
 	}
-	data, err := os.ReadFile(filepath.Join(pwd, path))
+	config, err := LoadConfig(filepath.Join(pwd, path))
 	if err != nil {
 		return
 	}
-	config = new(Config)
-	err = v2.Unmarshal(data, config)
+	defaultEngine.config = config
 
 	return
 }
+
+// LoadConfig reads the yaml config at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := new(Config)
+	if err = v2.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
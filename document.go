@@ -1,21 +1,27 @@
 package template
 
 import (
-	"strings"
+	"io"
 	"sync"
 
 	"github.com/pkg/errors"
 )
 
-var (
-	_cache = &documents{
+func newDocuments() *documents {
+	return &documents{
 		cache:  make(map[string]*Document),
 		locker: &sync.RWMutex{},
 	}
-)
+}
 
-func newDocument() *Document {
-	return &Document{blocks: make(map[string]*blockDirect)}
+func newDocument(engine *Engine, name string) *Document {
+	return &Document{
+		engine: engine,
+		name:   name,
+		blocks: make(map[string]*blockDirect),
+		macros: make(macroNamespace),
+		uses:   make(map[string]*Document),
+	}
 }
 
 type documents struct {
@@ -35,6 +41,14 @@ func (docs *documents) addDoc(name string, doc *Document) error {
 	return nil
 }
 
+// setDoc caches doc under name, replacing the document cached before.
+func (docs *documents) setDoc(name string, doc *Document) {
+	docs.locker.Lock()
+	defer docs.locker.Unlock()
+
+	docs.cache[name] = doc
+}
+
 func (docs *documents) doc(name string) *Document {
 	docs.locker.RLock()
 	defer docs.locker.RUnlock()
@@ -46,10 +60,20 @@ func (docs *documents) doc(name string) *Document {
 	return nil
 }
 
+// macroNamespace holds the macros of a document by name, it's the value an
+// {% import %} binds its alias to.
+type macroNamespace map[string]*macroDirect
+
 type Document struct {
+	engine *Engine
+	name   string
+	hash   string               // hash of the source code
+	deps   []string             // names of the extended and included documents
+	uses   map[string]*Document // documents of deps it's built with, by name
 	extend *extendDirect
 	body   *sectionDirect
 	blocks map[string]*blockDirect
+	macros macroNamespace
 
 	extended bool
 }
@@ -62,27 +86,43 @@ func (doc *Document) Block(name string) *blockDirect {
 	return nil
 }
 
-func (doc *Document) execute(p Params) (string, error) {
+func (doc *Document) execute(w io.Writer, p Params) error {
 	if p == nil {
 		p = make(Params)
 	}
-	sb := &strings.Builder{}
+	p.setEngine(doc.engine)
 	nd := doc
 	if doc.extend != nil {
 		nd = doc.extend.doc
 		for n, b := range doc.blocks {
 			p.setBlock(n, b)
 		}
+		p.setMacros(nd.macros)
+		// the body of a child document is replaced by its parent, but the
+		// macros it imports are still visible to its blocks.
+		doc.imports(p)
 	}
-	for _, v := range nd.body.list {
-		if str, err := v.execute(p); err != nil {
-			return "", err
-		} else {
-			sb.WriteString(str)
-		}
+	p.setMacros(doc.macros)
+	if doc.extend != nil {
+		return enter(nd.body.execute(w, p), "extend", doc.extend.path.value)
 	}
 
-	return sb.String(), nil
+	return nd.body.execute(w, p)
+}
+
+// imports runs the import and from directs at the top of doc into p.
+func (doc *Document) imports(p Params) {
+	if doc.body == nil {
+		return
+	}
+	for _, x := range doc.body.list {
+		switch x := x.(type) {
+		case *importDirect:
+			x.bind(p)
+		case *fromDirect:
+			x.bind(p)
+		}
+	}
 }
 
 func (doc *Document) append(x direct) {
@@ -93,11 +133,14 @@ func (doc *Document) append(x direct) {
 }
 
 func (d *Document) validate() error {
+	var errs ErrorList
 	if d.extend != nil {
-		if err := d.extend.validate(); err != nil {
-			return err
-		}
+		errs.add(d.extend.validate())
+	}
+	if d.body != nil {
+		errs.add(d.body.validate())
+		errs.add(strayJumps(d, d.body))
 	}
 
-	return d.body.validate()
+	return errs.err()
 }
@@ -0,0 +1,193 @@
+package template
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	defaultEngine = NewEngine(nil)
+)
+
+// Engine owns a template configuration together with the document cache,
+// funcs and filters used by the templates it renders. Engines are independent
+// of each other, so several of them can live in one binary.
+type Engine struct {
+	config   *Config
+	loader   Loader
+	cache    *documents
+	funcs    *funcMap
+	filters  *filterMap
+	compares *compareMap
+	clock    func() time.Time
+}
+
+// NewEngine returns an engine using config, which may be nil.
+func NewEngine(config *Config) *Engine {
+	e := &Engine{
+		config:   config,
+		cache:    newDocuments(),
+		funcs:    newFuncMap(),
+		filters:  newFilterMap(),
+		compares: newCompareMap(),
+	}
+	// the time of now() and timeago is read from the clock of the engine
+	e.funcs.store["now"] = reflect.ValueOf(e.now)
+	e.filters.store["timeago"] = reflect.ValueOf(func(v any) (string, error) {
+		return timeago(v, e.now())
+	})
+
+	return e
+}
+
+// SetClock sets the clock now() and the timeago filter read the current time
+// from, time.Now by default. It's meant for tests and must be called before
+// rendering.
+func (e *Engine) SetClock(clock func() time.Time) {
+	e.clock = clock
+}
+
+func (e *Engine) now() time.Time {
+	if e.clock != nil {
+		return e.clock()
+	}
+
+	return time.Now()
+}
+
+// Config returns the config of the engine, or nil.
+func (e *Engine) Config() *Config {
+	return e.config
+}
+
+// SetLoader sets the loader which templates, including extended, included
+// and warmed up ones, are read from. By default templates are read from the
+// TplDir of the config.
+func (e *Engine) SetLoader(loader Loader) {
+	e.loader = loader
+}
+
+func (e *Engine) getLoader() Loader {
+	if e.loader != nil {
+		return e.loader
+	}
+	if e.config == nil {
+		return NewDirLoader(filepath.Join(pwd, "."))
+	}
+
+	return NewDirLoader(filepath.Join(pwd, e.config.TplDir))
+}
+
+func (e *Engine) autoReload() bool {
+	return e.config != nil && e.config.AutoReload
+}
+
+func (e *Engine) RegisterFunc(name string, fn any) error {
+	return e.funcs.register(name, fn)
+}
+
+func (e *Engine) RegisterFilter(name string, fn any) error {
+	return e.filters.register(name, fn)
+}
+
+// RegisterCompare sets the func(x, y T) int ordering the values of type T,
+// it's used to sort the keys of maps iterated by for loops and by the
+// filters ordering values. cmp returns a negative number if x is less than
+// y, zero if they're equal and a positive number otherwise.
+func (e *Engine) RegisterCompare(cmp any) error {
+	return e.compares.register(cmp)
+}
+
+func (e *Engine) Render(path string, writer io.Writer, ps Params) error {
+	return e.RenderContext(context.Background(), path, writer, ps)
+}
+
+// RenderContext renders the template at path like Render. Rendering stops
+// with a *RenderError wrapping ctx.Err() once ctx is done.
+func (e *Engine) RenderContext(ctx context.Context, path string, writer io.Writer, ps Params) (err error) {
+	doc, err := e.buildFileTemplate(path)
+	if err != nil {
+		return
+	}
+
+	return e.execute(ctx, doc, writer, ps)
+}
+
+func (e *Engine) RenderView(tpl string, writer io.Writer, ps Params) error {
+	return e.RenderViewContext(context.Background(), tpl, writer, ps)
+}
+
+// RenderViewContext renders the template source tpl like RenderView,
+// stopping once ctx is done.
+func (e *Engine) RenderViewContext(ctx context.Context, tpl string, writer io.Writer, ps Params) (err error) {
+	doc, err := e.buildTemplate(tpl)
+	if err != nil {
+		return
+	}
+
+	return e.execute(ctx, doc, writer, ps)
+}
+
+// execute renders doc into writer through a buffer. Output is streamed, so
+// writer may have received part of the document when an error is returned.
+// The render state is kept in a copy of ps, which is left untouched so that
+// it can be shared by concurrent renders.
+func (e *Engine) execute(ctx context.Context, doc *Document, writer io.Writer, ps Params) error {
+	ps = cop(ps)
+	ps.setContext(ctx)
+	bw := bufio.NewWriter(writer)
+	if err := doc.execute(bw, ps); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func (e *Engine) WarmUp() (err error) {
+	names, err := e.Templates()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if _, err = e.buildFileTemplate(name); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Templates returns the names of the templates served by the loader, which
+// are the files with the configured ExtName.
+func (e *Engine) Templates() ([]string, error) {
+	if e.config == nil || e.config.ExtName == "" {
+		return nil, errors.New("template: template extension name isn't configured")
+	}
+	if e.loader == nil && e.config.TplDir == "" {
+		return nil, errors.New("template: template dir isn't configured")
+	}
+	lister, ok := e.getLoader().(Lister)
+	if !ok {
+		return nil, errors.Errorf("template: loader %T can't list templates", e.getLoader())
+	}
+	names, err := lister.List()
+	if err != nil {
+		return nil, err
+	}
+	suffix := "." + e.config.ExtName
+	var templates []string
+	for _, name := range names {
+		if strings.HasSuffix(name, suffix) {
+			templates = append(templates, name)
+		}
+	}
+
+	return templates, nil
+}
@@ -1,11 +1,195 @@
 package template
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorCode is a stable identifier of the kind of an error.
+type ErrorCode string
+
+const (
+	CodeUnexpectedToken ErrorCode = "unexpected_token"
+	CodeUnclosedToken   ErrorCode = "unclosed_token"
+	CodeUnexpectedEOF   ErrorCode = "unexpected_eof"
+	CodeInvalidExpr     ErrorCode = "invalid_expr"
+	CodeMisplaced       ErrorCode = "misplaced_direct"
+	CodeDuplicateBlock  ErrorCode = "duplicate_block"
+	CodeDuplicateMacro  ErrorCode = "duplicate_macro"
+	CodeUndefinedVar    ErrorCode = "undefined_var"
+	CodeUndefinedFunc   ErrorCode = "undefined_func"
+	CodeUndefinedFilter ErrorCode = "undefined_filter"
+	CodeUndefinedMacro  ErrorCode = "undefined_macro"
+	CodeUndefinedBlock  ErrorCode = "undefined_block"
+	CodeUnusedVar       ErrorCode = "unused_var"
+	CodeTypeMismatch    ErrorCode = "type_mismatch"
+	CodeLoadFailed      ErrorCode = "load_failed"
+	CodeExecFailed      ErrorCode = "exec_failed"
+	CodeInterrupted     ErrorCode = "interrupted"
+)
+
+// Error is implemented by all the errors reported for a template, use
+// errors.As to find it in a chain of errors.
+type Error interface {
+	error
+	ErrorCode() ErrorCode
+	Where() *Location
+}
 
 func newUnexpectedToken(tok *token) error {
-	return &UnexpectedToken{Line: tok.line, token: tok.value}
+	return newSyntaxError(CodeUnexpectedToken, tok, "Unexpected token \"%s\"", tok.value)
+}
+
+func newSyntaxError(code ErrorCode, tok *token, format string, args ...any) error {
+	if tok == nil {
+		tok = &token{}
+	}
+	return &SyntaxError{Location: tok.location(), Code: code, Token: tok.value, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Frame is a step of the include/extend chain that led to an error, it
+// points at the directive the step is taken from.
+type Frame struct {
+	Via    string // "include", "extend", "import" or "macro"
+	Name   string // name of the template; empty for views
+	Line   int
+	Column int
+}
+
+func (f Frame) String() string {
+	switch f.Via {
+	case "include":
+		return "included from " + position(f.Name, f.Line, f.Column)
+	case "extend":
+		return "extended by " + position(f.Name, f.Line, f.Column)
+	case "macro":
+		return "called from " + position(f.Name, f.Line, f.Column)
+	}
+
+	return "imported from " + position(f.Name, f.Line, f.Column)
+}
+
+// Location locates an error in the source of a template.
+type Location struct {
+	Name   string // name of the template; empty for views
+	Line   int
+	Column int
+	Chain  []Frame     // include/extend chain that led to the error, innermost first
+	src    *sourceCode // source the snippet is taken from; or nil
 }
 
+// Where returns the location itself, it's promoted to the errors embedding
+// a Location.
+func (l *Location) Where() *Location {
+	return l
+}
+
+// Snippet returns the nearby lines of the source, the bad one highlighted.
+// It's built on demand, since most errors are never displayed.
+func (l *Location) Snippet() string {
+	if l.src == nil {
+		return ""
+	}
+
+	return l.src.snippet(l.Line, l.Column)
+}
+
+func (l *Location) String() string {
+	var sb strings.Builder
+	sb.WriteString(position(l.Name, l.Line, l.Column))
+	for _, f := range l.Chain {
+		sb.WriteString(", ")
+		sb.WriteString(f.String())
+	}
+
+	return sb.String()
+}
+
+func position(name string, line, column int) string {
+	if name == "" {
+		return fmt.Sprintf("line %d, column %d", line, column)
+	}
+
+	return fmt.Sprintf("%q line %d, column %d", name, line, column)
+}
+
+// locate returns err located at tok, errors which already know where they
+// happened are returned as they are.
+func locate(err error, tok *token) error {
+	if err == nil || tok == nil {
+		return err
+	}
+	var l Error
+	if errors.As(err, &l) {
+		if loc := l.Where(); loc.Line == 0 {
+			*loc = tok.location()
+		}
+		return err
+	}
+
+	return &ExecError{Location: tok.location(), Code: CodeExecFailed, Err: err}
+}
+
+// enter records that err happened in a template entered via the directive
+// at tok, such as an include.
+func enter(err error, via string, tok *token) error {
+	if err == nil {
+		return nil
+	}
+	var l Error
+	if !errors.As(err, &l) || l.Where().Line == 0 {
+		return locate(err, tok)
+	}
+	loc := l.Where()
+	loc.Chain = append(loc.Chain, Frame{Via: via, Name: tok.name(), Line: tok.line, Column: tok.col})
+
+	return err
+}
+
+// SyntaxError reports a template which can't be parsed or is malformed.
+type SyntaxError struct {
+	Location
+	Code  ErrorCode
+	Token string // text of the offending token
+	Msg   string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s in %s", e.Msg, &e.Location)
+}
+
+func (e *SyntaxError) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+// As lets errors.As find the syntax errors as the deprecated error types of
+// their code.
+func (e *SyntaxError) As(target any) bool {
+	switch t := target.(type) {
+	case **UnexpectedToken:
+		if e.Code == CodeUnexpectedToken {
+			*t = &UnexpectedToken{Line: e.Line, token: e.Token}
+			return true
+		}
+	case **UnClosedToken:
+		if e.Code == CodeUnclosedToken {
+			*t = &UnClosedToken{Line: e.Line, token: e.Token}
+			return true
+		}
+	case *UnexpectedEndOfFile:
+		if e.Code == CodeUnexpectedEOF {
+			*t = UnexpectedEndOfFile{}
+			return true
+		}
+	}
+
+	return false
+}
+
+// Deprecated: UnexpectedEndOfFile is kept for compatibility, use SyntaxError
+// with the code CodeUnexpectedEOF.
 type UnexpectedEndOfFile struct {
 }
 
@@ -13,6 +197,8 @@ func (e UnexpectedEndOfFile) Error() string {
 	return "Unexpected end of file."
 }
 
+// Deprecated: UnClosedToken is kept for compatibility, use SyntaxError with
+// the code CodeUnclosedToken.
 type UnClosedToken struct {
 	Line  int
 	token string
@@ -22,6 +208,8 @@ func (e *UnClosedToken) Error() string {
 	return fmt.Sprintf("Unclosed token \"%s\" in line %d", e.token, e.Line)
 }
 
+// Deprecated: UnexpectedToken is kept for compatibility, use SyntaxError with
+// the code CodeUnexpectedToken.
 type UnexpectedToken struct {
 	Line  int
 	token string
@@ -30,3 +218,213 @@ type UnexpectedToken struct {
 func (e *UnexpectedToken) Error() string {
 	return fmt.Sprintf("Unexpected token \"%s\" in line %d", e.token, e.Line)
 }
+
+// UndefinedError reports a variable, func, filter or macro which doesn't
+// exist.
+type UndefinedError struct {
+	Location
+	Code  ErrorCode
+	Ident string // name of the undefined object
+	Err   error  // more details; or nil
+}
+
+func newUndefinedError(code ErrorCode, tok *token, name string) *UndefinedError {
+	return &UndefinedError{Location: tok.location(), Code: code, Ident: name}
+}
+
+func (e *UndefinedError) Error() string {
+	var what string
+	switch e.Code {
+	case CodeUndefinedVar:
+		what = "variable"
+	case CodeUndefinedFunc:
+		what = "func"
+	case CodeUndefinedFilter:
+		what = "filter"
+	case CodeUndefinedBlock:
+		what = "block"
+	default:
+		what = "macro"
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s named %s doesn't exist in %s: %s", what, e.Ident, &e.Location, e.Err)
+	}
+
+	return fmt.Sprintf("%s named %s doesn't exist in %s", what, e.Ident, &e.Location)
+}
+
+func (e *UndefinedError) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+func (e *UndefinedError) Unwrap() error {
+	return e.Err
+}
+
+// TypeError reports a value which can't be used as required, such as
+// ranging over a number.
+type TypeError struct {
+	Location
+	Code ErrorCode
+	Err  error
+}
+
+func newTypeError(tok *token, err error) error {
+	if err == nil {
+		return nil
+	}
+	var l Error
+	if errors.As(err, &l) {
+		return err
+	}
+	if tok == nil {
+		return &TypeError{Code: CodeTypeMismatch, Err: err}
+	}
+
+	return &TypeError{Location: tok.location(), Code: CodeTypeMismatch, Err: err}
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("%s in %s", e.Err, &e.Location)
+}
+
+func (e *TypeError) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+func (e *TypeError) Unwrap() error {
+	return e.Err
+}
+
+// LoadError reports a template which can't be loaded, it's located at the
+// directive loading the template if any.
+type LoadError struct {
+	Location
+	Code     ErrorCode
+	Template string // name of the template failed to load
+	Err      error
+}
+
+func (e *LoadError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("can't load template %q: %s", e.Template, e.Err)
+	}
+
+	return fmt.Sprintf("can't load template %q in %s: %s", e.Template, &e.Location, e.Err)
+}
+
+func (e *LoadError) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// RenderError reports that rendering stopped at a node of the template.
+type RenderError struct {
+	Location
+	kind string
+	name string
+	Err  error
+}
+
+func (e *RenderError) Error() string {
+	where := e.kind
+	if e.name != "" {
+		where += " " + e.name
+	}
+
+	return fmt.Sprintf("Render stopped at %s in %s: %s", where, &e.Location, e.Err)
+}
+
+func (e *RenderError) ErrorCode() ErrorCode {
+	return CodeInterrupted
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// ExecError reports an error raised by a func, filter or method while
+// rendering.
+type ExecError struct {
+	Location
+	Code ErrorCode
+	Err  error
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("%s in %s", e.Err, &e.Location)
+}
+
+func (e *ExecError) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// LintError reports a template which renders but is likely wrong, such as a
+// variable set but never used.
+type LintError struct {
+	Location
+	Code ErrorCode
+	Msg  string
+}
+
+func (e *LintError) Error() string {
+	return fmt.Sprintf("%s in %s", e.Msg, &e.Location)
+}
+
+func (e *LintError) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+// ErrorList is the list of problems found in a template.
+type ErrorList []error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "%d errors:", len(l))
+	for _, err := range l {
+		sb.WriteString("\n\t")
+		sb.WriteString(err.Error())
+	}
+
+	return sb.String()
+}
+
+func (l ErrorList) Unwrap() []error {
+	return l
+}
+
+// add appends err to the list, the errors of a nested list are flattened.
+func (l *ErrorList) add(err error) {
+	switch err := err.(type) {
+	case nil:
+	case ErrorList:
+		*l = append(*l, err...)
+	default:
+		*l = append(*l, err)
+	}
+}
+
+// err returns nil if the list is empty, the only error if it has one.
+func (l ErrorList) err() error {
+	switch len(l) {
+	case 0:
+		return nil
+	case 1:
+		return l[0]
+	}
+
+	return l
+}
@@ -0,0 +1,710 @@
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	htmlTemplate "html/template"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	textTemplate "text/template"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// SafeString is a string that is already safe for the place it's written to,
+// values of this type are never escaped.
+type SafeString string
+
+// An escaper tells how a value is escaped before it's written into the
+// document. The low bits hold the strategy, the high bits tell whether the
+// result is written into an html attribute value.
+type escaper uint8
+
+const (
+	escape_none escaper = iota
+	escape_html
+	escape_html_unquoted
+	escape_url
+	escape_url_path
+	escape_url_query
+	escape_js
+	escape_js_string
+	escape_js_regexp
+	escape_css
+
+	escape_in_attr          escaper = 1 << 6
+	escape_in_unquoted_attr escaper = 1 << 7
+	escape_strategy_mask    escaper = escape_in_attr - 1
+)
+
+func (esc escaper) strategy() escaper {
+	return esc & escape_strategy_mask
+}
+
+var escapeStrategies = map[string]escaper{
+	"html":  escape_html,
+	"js":    escape_js,
+	"css":   escape_css,
+	"url":   escape_url_query,
+	"json":  escape_js,
+	"none":  escape_none,
+	"true":  escape_html,
+	"false": escape_none,
+}
+
+// escaperOf returns the escaper of the strategy named name.
+func escaperOf(name string) (escaper, bool) {
+	esc, ok := escapeStrategies[name]
+
+	return esc, ok
+}
+
+// isHTMLName reports whether the template named name is an html template,
+// e.g. "index.html" or "index.html.tpl".
+func isHTMLName(name string) bool {
+	base := path.Base(name)
+	i := strings.Index(base, ".")
+	if name == "" || i < 0 {
+		return false
+	}
+	for _, ext := range strings.Split(base[i+1:], ".") {
+		if ext == "html" || ext == "htm" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func escapeValue(v reflect.Value, esc escaper) (string, error) {
+	v = uncoverInterface(v)
+	if v.IsValid() && v.CanInterface() {
+		if str, ok := safeValue(v.Interface(), esc.strategy()); ok {
+			return str, nil
+		}
+	}
+
+	var (
+		str string
+		err error
+	)
+	if esc.strategy() == escape_js {
+		var bs []byte
+		if v.IsValid() && v.CanInterface() {
+			bs, err = json.Marshal(v.Interface())
+		} else {
+			bs, err = json.Marshal(nil)
+		}
+		if err != nil {
+			return "", errors.Errorf("can't use type %s as javascript value", v.Type())
+		}
+		str = string(bs)
+	} else if str, err = strValue(v); err != nil {
+		return "", err
+	}
+
+	switch esc.strategy() {
+	case escape_html:
+		str = htmlEscape(str)
+	case escape_html_unquoted:
+		str = htmlUnquotedEscape(str)
+	case escape_url:
+		str = urlNormalize(urlFilter(str))
+	case escape_url_path:
+		str = urlNormalize(str)
+	case escape_url_query:
+		str = urlQueryEscape(str)
+	case escape_js_string:
+		str = jsStringEscape(str)
+	case escape_js_regexp:
+		str = jsRegexpEscape(str)
+	case escape_css:
+		str = cssEscape(str)
+	}
+
+	switch {
+	case esc&escape_in_unquoted_attr != 0:
+		str = htmlUnquotedEscape(str)
+	case esc&escape_in_attr != 0:
+		str = htmlEscape(str)
+	}
+
+	return str, nil
+}
+
+// safeValue returns the content of x if it's marked safe for strategy.
+func safeValue(x any, strategy escaper) (string, bool) {
+	switch s := x.(type) {
+	case SafeString:
+		return string(s), true
+	case htmlTemplate.HTML:
+		return string(s), strategy == escape_html || strategy == escape_html_unquoted
+	case htmlTemplate.HTMLAttr:
+		return string(s), strategy == escape_html_unquoted
+	case htmlTemplate.URL:
+		return string(s), strategy == escape_url || strategy == escape_url_path || strategy == escape_url_query
+	case htmlTemplate.JS:
+		return string(s), strategy == escape_js
+	case htmlTemplate.JSStr:
+		return string(s), strategy == escape_js_string || strategy == escape_js_regexp
+	case htmlTemplate.CSS:
+		return string(s), strategy == escape_css
+	}
+
+	return "", false
+}
+
+var (
+	htmlReplacer = strings.NewReplacer(
+		"&", "&amp;",
+		"<", "&lt;",
+		">", "&gt;",
+		`"`, "&#34;",
+		"'", "&#39;",
+		"\x00", "\uFFFD",
+	)
+
+	htmlUnquotedReplacer = strings.NewReplacer(
+		"&", "&amp;",
+		"<", "&lt;",
+		">", "&gt;",
+		`"`, "&#34;",
+		"'", "&#39;",
+		"\x00", "\uFFFD",
+		" ", "&#32;",
+		"\t", "&#9;",
+		"\n", "&#10;",
+		"\f", "&#12;",
+		"\r", "&#13;",
+		"=", "&#61;",
+		"`", "&#96;",
+	)
+)
+
+func htmlEscape(s string) string {
+	return htmlReplacer.Replace(s)
+}
+
+func htmlUnquotedEscape(s string) string {
+	return htmlUnquotedReplacer.Replace(s)
+}
+
+// urlFilter replaces urls with a scheme other than http, https and mailto,
+// such as "javascript:", by a harmless placeholder.
+func urlFilter(s string) string {
+	if i := strings.IndexByte(s, ':'); i >= 0 && !strings.ContainsAny(s[:i], "/?#") {
+		switch strings.ToLower(s[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "#ZgotmplZ"
+		}
+	}
+
+	return s
+}
+
+// urlNormalize percent-encodes the bytes of s which aren't allowed in urls,
+// leaving existing escapes and url delimiters as they are.
+func urlNormalize(s string) string {
+	sb := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x80 && (isAlnum(c) || strings.IndexByte("!#$%&*+,-./:;=?@[]_~()'", c) >= 0) {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(sb, "%%%02X", c)
+	}
+
+	return sb.String()
+}
+
+// jsStringReplacer escapes what JSEscapeString leaves out, but ends or
+// interpolates template literals.
+var jsStringReplacer = strings.NewReplacer(
+	"`", `\u0060`,
+	"$", `\u0024`,
+	"{", `\u007B`,
+	"}", `\u007D`,
+)
+
+// jsStringEscape escapes s to be placed in a quoted or template literal
+// javascript string.
+func jsStringEscape(s string) string {
+	return jsStringReplacer.Replace(textTemplate.JSEscapeString(s))
+}
+
+// jsRegexpEscape escapes s to be matched literally in a javascript regular
+// expression literal.
+func jsRegexpEscape(s string) string {
+	sb := &strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune("^*+?.()|[]/", r) {
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+			continue
+		}
+		sb.WriteString(jsStringEscape(string(r)))
+	}
+
+	return sb.String()
+}
+
+func urlQueryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func cssEscape(s string) string {
+	sb := &strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune("\x00\t\n\f\r\"&'()+/:;<>\\{}", r) || !unicode.IsPrint(r) {
+			fmt.Fprintf(sb, "\\%X ", r)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+const (
+	html_state_text = iota
+	html_state_comment
+	html_state_tag_name
+	html_state_tag
+	html_state_attr_name
+	html_state_after_attr_name
+	html_state_before_value
+	html_state_attr_value
+	html_state_script
+	html_state_style
+)
+
+const (
+	attr_plain = iota
+	attr_url
+	attr_js
+	attr_css
+)
+
+const (
+	url_part_start = iota
+	url_part_path
+	url_part_query
+)
+
+// htmlContext follows the text of an html template to tell the context the
+// values in between are written to, similar to html/template. The text is
+// fed in source order, branches of if and for directs are not told apart.
+type htmlContext struct {
+	state    int
+	tagName  string
+	closing  bool
+	attrName string
+	attr     int
+	quote    byte
+	urlPart  int
+	js       jsContext
+}
+
+func (c *htmlContext) feed(s string) {
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch c.state {
+		case html_state_text:
+			if ch != '<' {
+				continue
+			}
+			if strings.HasPrefix(s[i:], "<!--") {
+				c.state = html_state_comment
+				i += 3
+			} else if i+1 < len(s) && (s[i+1] == '/' || isLetter(s[i+1])) {
+				c.state, c.tagName, c.closing = html_state_tag_name, "", false
+			}
+
+		case html_state_comment:
+			if strings.HasPrefix(s[i:], "-->") {
+				c.state = html_state_text
+				i += 2
+			}
+
+		case html_state_tag_name:
+			switch {
+			case ch == '/' && c.tagName == "":
+				c.closing = true
+			case ch == '>':
+				c.endTag()
+			case isSpace(ch) || ch == '/':
+				c.state = html_state_tag
+			default:
+				c.tagName += string(lower(ch))
+			}
+
+		case html_state_tag:
+			switch {
+			case ch == '>':
+				c.endTag()
+			case isSpace(ch) || ch == '/':
+			default:
+				c.state, c.attrName = html_state_attr_name, string(lower(ch))
+			}
+
+		case html_state_attr_name:
+			switch {
+			case ch == '=':
+				c.state = html_state_before_value
+			case ch == '>':
+				c.endTag()
+			case ch == '/':
+				c.state = html_state_tag
+			case isSpace(ch):
+				c.state = html_state_after_attr_name
+			default:
+				c.attrName += string(lower(ch))
+			}
+
+		case html_state_after_attr_name:
+			switch {
+			case ch == '=':
+				c.state = html_state_before_value
+			case ch == '>':
+				c.endTag()
+			case isSpace(ch):
+			default:
+				c.state, c.attrName = html_state_attr_name, string(lower(ch))
+			}
+
+		case html_state_before_value:
+			switch {
+			case isSpace(ch):
+			case ch == '>':
+				c.endTag()
+			case ch == '"' || ch == '\'':
+				c.startValue(ch)
+			default:
+				c.startValue(0)
+				c.value(ch)
+			}
+
+		case html_state_attr_value:
+			switch {
+			case c.quote != 0 && ch == c.quote, c.quote == 0 && isSpace(ch):
+				c.state = html_state_tag
+			case c.quote == 0 && ch == '>':
+				c.endTag()
+			default:
+				c.value(ch)
+			}
+
+		case html_state_script:
+			// like browsers do, the script ends even in a string or comment
+			if hasPrefixFold(s[i:], "</script") {
+				c.state, c.tagName, c.closing = html_state_tag_name, "", true
+				i++
+				continue
+			}
+			c.js.feed(ch)
+
+		case html_state_style:
+			if hasPrefixFold(s[i:], "</style") {
+				c.state, c.tagName, c.closing = html_state_tag_name, "", true
+				i++
+			}
+		}
+	}
+}
+
+func (c *htmlContext) endTag() {
+	c.state = html_state_text
+	if c.closing {
+		return
+	}
+	switch c.tagName {
+	case "script":
+		c.state, c.js = html_state_script, jsContext{}
+	case "style":
+		c.state = html_state_style
+	}
+}
+
+func (c *htmlContext) startValue(quote byte) {
+	c.state, c.quote = html_state_attr_value, quote
+	c.js, c.urlPart = jsContext{}, url_part_start
+	switch {
+	case strings.HasPrefix(c.attrName, "on"):
+		c.attr = attr_js
+	case c.attrName == "style":
+		c.attr = attr_css
+	case isURLAttr(c.attrName):
+		c.attr = attr_url
+	default:
+		c.attr = attr_plain
+	}
+}
+
+func (c *htmlContext) value(ch byte) {
+	switch c.attr {
+	case attr_js:
+		c.js.feed(ch)
+	case attr_url:
+		switch {
+		case c.urlPart == url_part_start && isSpace(ch):
+			// browsers skip the leading spaces of urls
+		case ch == '?' || ch == '#':
+			c.urlPart = url_part_query
+		case c.urlPart == url_part_start:
+			c.urlPart = url_part_path
+		}
+	}
+}
+
+// escaper returns the escaper of a value written at the current position,
+// values in an attribute continue its value.
+func (c *htmlContext) escaper() escaper {
+	if c.state == html_state_before_value {
+		c.startValue(0)
+	}
+	switch c.state {
+	case html_state_attr_value:
+		in := escape_in_attr
+		if c.quote == 0 {
+			in = escape_in_unquoted_attr
+		}
+		switch c.attr {
+		case attr_url:
+			part := c.urlPart
+			if part == url_part_start {
+				c.urlPart = url_part_path
+			}
+			switch part {
+			case url_part_start:
+				return escape_url | in
+			case url_part_path:
+				return escape_url_path | in
+			}
+			return escape_url_query | in
+		case attr_js:
+			return c.js.escaper() | in
+		case attr_css:
+			return escape_css | in
+		}
+		if c.quote == 0 {
+			return escape_html_unquoted
+		}
+
+		return escape_html
+
+	case html_state_script:
+		return c.js.escaper()
+
+	case html_state_style:
+		return escape_css
+
+	case html_state_tag, html_state_tag_name, html_state_attr_name, html_state_after_attr_name:
+		return escape_html_unquoted
+	}
+
+	return escape_html
+}
+
+const (
+	js_state_code = iota
+	js_state_string
+	js_state_regexp
+	js_state_line_comment
+	js_state_block_comment
+)
+
+// js_regexp_keywords are the keywords after which a slash starts a regular
+// expression rather than a division.
+var js_regexp_keywords = map[string]bool{
+	"await": true, "case": true, "delete": true, "do": true, "else": true, "in": true,
+	"instanceof": true, "new": true, "of": true, "return": true, "throw": true,
+	"typeof": true, "void": true, "yield": true,
+}
+
+// jsContext follows javascript code to tell whether a value is written into
+// code, a string, a template literal, a regular expression or a comment.
+type jsContext struct {
+	state  int
+	quote  byte   // quote of the string, ` for template literals
+	escape bool   // the previous char of a string or regexp is a backslash
+	class  bool   // in a character class of a regexp
+	slash  bool   // a slash was just read in code, it starts a comment, a regexp or is a division
+	dollar bool   // a $ was just read in a template literal
+	star   bool   // a * was just read in a block comment
+	space  bool   // a white space was read after prev
+	prev   byte   // the last char of code which isn't a white space
+	word   string // the identifier or keyword ending at prev
+	braces []int  // the braces opened in each ${} of template literals
+}
+
+func (c *jsContext) feed(ch byte) {
+	if c.slash {
+		c.slash = false
+		switch ch {
+		case '/':
+			c.state = js_state_line_comment
+			return
+		case '*':
+			c.state, c.star = js_state_block_comment, false
+			return
+		}
+		c.divideOrRegexp()
+	}
+	if c.dollar {
+		c.dollar = false
+		if ch == '{' {
+			c.state, c.braces = js_state_code, append(c.braces, 0)
+			c.code('{')
+			return
+		}
+	}
+
+	switch c.state {
+	case js_state_line_comment:
+		if ch == '\n' || ch == '\r' {
+			c.state = js_state_code
+		}
+
+	case js_state_block_comment:
+		if c.star && ch == '/' {
+			c.state = js_state_code
+		}
+		c.star = ch == '*'
+
+	case js_state_string, js_state_regexp:
+		regexp := c.state == js_state_regexp
+		switch {
+		case c.escape:
+			c.escape = false
+		case ch == '\\':
+			c.escape = true
+		case regexp && ch == '[':
+			c.class = true
+		case regexp && ch == ']':
+			c.class = false
+		case regexp && ch == '/' && !c.class, !regexp && ch == c.quote:
+			// the literal is a value, a slash after it is a division
+			c.state = js_state_code
+			c.code('"')
+		case !regexp && c.quote == '`' && ch == '$':
+			c.dollar = true
+		}
+
+	default:
+		switch {
+		case ch == '/':
+			c.slash = true
+		case ch == '"' || ch == '\'' || ch == '`':
+			c.state, c.quote, c.escape = js_state_string, ch, false
+		case ch == '}' && len(c.braces) > 0 && c.braces[len(c.braces)-1] == 0:
+			c.braces = c.braces[:len(c.braces)-1]
+			c.state, c.quote, c.escape = js_state_string, '`', false
+		default:
+			if len(c.braces) > 0 {
+				switch ch {
+				case '{':
+					c.braces[len(c.braces)-1]++
+				case '}':
+					c.braces[len(c.braces)-1]--
+				}
+			}
+			c.code(ch)
+		}
+	}
+}
+
+// code reads ch in code, outside of strings, regexps and comments.
+func (c *jsContext) code(ch byte) {
+	switch {
+	case isSpace(ch):
+		c.space = true
+		return
+	case isJSIdent(ch):
+		if c.space || !isJSIdent(c.prev) {
+			c.word = ""
+		}
+		c.word += string(ch)
+	default:
+		c.word = ""
+	}
+	c.prev, c.space = ch, false
+}
+
+// divideOrRegexp tells whether the slash just read starts a regexp, or is a
+// division.
+func (c *jsContext) divideOrRegexp() {
+	regexp := true
+	switch {
+	case c.word != "":
+		regexp = js_regexp_keywords[c.word]
+	case c.prev == ')' || c.prev == ']' || c.prev == '"' || isJSIdent(c.prev):
+		regexp = false
+	}
+	if regexp {
+		c.state, c.class, c.escape = js_state_regexp, false, false
+	} else {
+		c.code('/')
+	}
+}
+
+// escaper returns the escaper of a value written at the current position.
+// Values in comments are escaped as in regexps, which can't end comments.
+func (c *jsContext) escaper() escaper {
+	if c.slash {
+		c.slash = false
+		c.divideOrRegexp()
+	}
+	c.dollar = false
+	switch c.state {
+	case js_state_string:
+		return escape_js_string
+	case js_state_regexp, js_state_line_comment, js_state_block_comment:
+		return escape_js_regexp
+	}
+	// the value is written as a javascript value
+	c.code('"')
+
+	return escape_js
+}
+
+func isJSIdent(c byte) bool {
+	return isAlnum(c) || c == '_' || c == '$' || c >= 0x80
+}
+
+func isURLAttr(name string) bool {
+	switch name {
+	case "href", "src", "action", "formaction", "cite", "data", "poster", "background", "longdesc", "usemap", "manifest", "codebase", "icon":
+		return true
+	}
+
+	return false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+
+	return c
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
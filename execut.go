@@ -1,14 +1,27 @@
 package template
 
 import (
+	"io"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+var (
+	// errBreak and errContinue are returned by the break and continue directs,
+	// and caught by the enclosing for loop.
+	errBreak    = errors.New("break outside of a for loop")
+	errContinue = errors.New("continue outside of a for loop")
+)
+
 func (e *ident) execute(p Params) (reflect.Value, error) {
+	if _, ok := p[e.name.value]; !ok {
+		return zeroValue, newUndefinedError(CodeUndefinedVar, e.name, e.name.value)
+	}
+
 	return get(p, e.name.value)
 }
 
@@ -52,21 +65,36 @@ func (e *indexExpr) execute(p Params) (reflect.Value, error) {
 	case ".":
 		switch index := e.index.(type) {
 		case *ident:
-			return get(vx, index.name.value)
+			v, err := get(vx, index.name.value)
+
+			return v, locate(err, index.name)
 		case *callExpr:
+			if ns, ok := vx.(macroNamespace); ok {
+				m, ok := ns[index.fn.name.value]
+				if !ok {
+					return zeroValue, newUndefinedError(CodeUndefinedMacro, index.fn.name, index.fn.name.value)
+				}
+				argv, err := index.argv(p)
+				if err != nil {
+					return zeroValue, err
+				}
+				v, err := m.call(p, argv)
+
+				return v, enter(err, "macro", index.fn.name)
+			}
 			if fn, err := method(x, index.fn.name.value); err != nil {
-				return zeroValue, err
+				return zeroValue, locate(err, index.fn.name)
 			} else {
-				argv := []reflect.Value{}
-				for _, v := range index.args.list {
-					if arg, err := v.execute(p); err == nil {
-						argv = append(argv, arg)
-					} else {
-						return zeroValue, err
-					}
+				argv, err := index.argv(p)
+				if err != nil {
+					return zeroValue, err
+				}
+				if err := p.interrupted(index.fn.name, "method", index.fn.name.value); err != nil {
+					return zeroValue, err
 				}
+				v, err := call(fn, argv...)
 
-				return call(fn, argv...)
+				return v, locate(err, index.fn.name)
 			}
 
 		default:
@@ -80,35 +108,64 @@ func (e *indexExpr) execute(p Params) (reflect.Value, error) {
 			return zeroValue, err
 		}
 		if v.CanInt() {
-			return get(vx, x)
-		}
-		if v.Kind() == reflect.String {
-			return get(vx, v.Interface().(string))
+			v, err = get(vx, x)
+		} else if v.Kind() == reflect.String {
+			v, err = get(vx, v.Interface().(string))
+		} else {
+			return zeroValue, newTypeError(e.op, errors.Errorf("con't convert %s(type of %s) to type string",
+				v,
+				reflect.TypeOf(v).Name(),
+			))
 		}
-		return zeroValue, errors.Errorf("con't convert %s(type of %s) to type string",
-			v,
-			reflect.TypeOf(v).Name(),
-		)
+
+		return v, locate(err, e.op)
 
 	default:
-		return zeroValue, errors.Errorf("unexpected index token %s", op)
+		return zeroValue, newUnexpectedToken(e.op)
 	}
 }
 
 func (e *callExpr) execute(p Params) (reflect.Value, error) {
-	if fn := getFunc(e.fn.name.value); fn != zeroValue {
-		argv := []reflect.Value{}
-		for _, v := range e.args.list {
-			if arg, err := v.execute(p); err == nil {
-				argv = append(argv, arg)
-			} else {
-				return zeroValue, err
-			}
+	if m := p.macro(e.fn.name.value); m != nil {
+		argv, err := e.argv(p)
+		if err != nil {
+			return zeroValue, err
+		}
+		v, err := m.call(p, argv)
+
+		return v, enter(err, "macro", e.fn.name)
+	}
+	if fn := p.engine().funcs.get(e.fn.name.value); fn != zeroValue {
+		argv, err := e.argv(p)
+		if err != nil {
+			return zeroValue, err
+		}
+		if err := p.interrupted(e.fn.name, "func", e.fn.name.value); err != nil {
+			return zeroValue, err
+		}
+		v, err := call(fn, argv...)
+
+		return v, locate(err, e.fn.name)
+	}
+
+	return zeroValue, newUndefinedError(CodeUndefinedFunc, e.fn.name, e.fn.name.value)
+}
+
+// argv evaluates the arguments of the call.
+func (e *callExpr) argv(p Params) ([]reflect.Value, error) {
+	if e.args == nil {
+		return nil, nil
+	}
+	argv := make([]reflect.Value, 0, len(e.args.list))
+	for _, v := range e.args.list {
+		arg, err := v.execute(p)
+		if err != nil {
+			return nil, err
 		}
-		return call(fn, argv...)
+		argv = append(argv, arg)
 	}
 
-	return zeroValue, errors.Errorf("func named %s doesn't exist", e.fn.name.value)
+	return argv, nil
 }
 
 func (e *binaryExpr) execute(p Params) (reflect.Value, error) {
@@ -121,6 +178,12 @@ func (e *binaryExpr) execute(p Params) (reflect.Value, error) {
 	if err != nil {
 		return zeroValue, err
 	}
+	v, err := e.eval(op, x, y)
+
+	return v, newTypeError(e.op, err)
+}
+
+func (e *binaryExpr) eval(op string, x, y reflect.Value) (reflect.Value, error) {
 	switch op {
 	case "+":
 		return add(x, y)
@@ -173,7 +236,7 @@ func (e *singleExpr) execute(p Params) (reflect.Value, error) {
 	case "not":
 		r, err := boolValue(x)
 		if err != nil {
-			return zeroValue, err
+			return zeroValue, newTypeError(e.op, err)
 		}
 
 		return reflect.ValueOf(!r), nil
@@ -184,186 +247,407 @@ func (e *singleExpr) execute(p Params) (reflect.Value, error) {
 }
 
 func (e *pipelineExpr) execute(p Params) (reflect.Value, error) {
-	if x, err := e.x.execute(p); err != nil {
+	if x, err := e.x.execute(p); err != nil && !e.defaults(err) {
 		return zeroValue, err
 	} else {
+		if err != nil {
+			x = zeroValue
+		}
 		var (
 			filter reflect.Value
+			name   *token
 			argv   = []reflect.Value{x}
 		)
 		switch y := e.y.(type) {
 		case *ident:
-			filter = getFilter(y.name.value)
-			if filter == zeroValue {
-				return zeroValue, errors.Errorf("filter named %s doesn't exist", y.name.value)
-			}
+			name = y.name
+			filter = p.engine().filters.get(y.name.value)
 
 		case *callExpr:
-			filter = getFilter(y.fn.name.value)
-			for _, v := range y.args.list {
-				if arg, err := v.execute(p); err == nil {
-					argv = append(argv, arg)
-				} else {
-					return zeroValue, err
-				}
+			name = y.fn.name
+			filter = p.engine().filters.get(y.fn.name.value)
+			args, err := y.argv(p)
+			if err != nil {
+				return zeroValue, err
 			}
+			argv = append(argv, args...)
 
 		}
+		if name == nil {
+			return zeroValue, newSyntaxError(CodeInvalidExpr, e.y.pos(), "unexpected filter %s", e.y.literal())
+		}
+		if filter == zeroValue {
+			return zeroValue, newUndefinedError(CodeUndefinedFilter, name, name.value)
+		}
+		if err := p.interrupted(name, "filter", name.value); err != nil {
+			return zeroValue, err
+		}
+		v, err := p.engine().callFilter(filter, argv...)
 
-		return call(filter, argv...)
+		return v, locate(err, name)
 	}
 }
 
-func (d *textDirect) execute(p Params) (string, error) {
-	return d.text.value.value, nil
+// defaults reports whether err, raised by the value the filter is applied to,
+// is an undefined variable, a missing map key or a missing attribute handed
+// over to the default filter.
+func (e *pipelineExpr) defaults(err error) bool {
+	name := e.y.pos()
+	if call, ok := e.y.(*callExpr); ok {
+		name = call.fn.name
+	}
+	if name.value != "default" {
+		return false
+	}
+	var (
+		undefined *UndefinedError
+		missing   missingError
+	)
+
+	return errors.As(err, &undefined) && undefined.Code == CodeUndefinedVar || errors.As(err, &missing)
 }
 
-func (d *valueDirect) execute(p Params) (string, error) {
-	if v, err := d.tok.execute(p); err != nil {
-		return "", err
+func (d *textDirect) execute(w io.Writer, p Params) error {
+	_, err := io.WriteString(w, d.text.value.value)
+
+	return err
+}
+
+func (d *valueDirect) execute(w io.Writer, p Params) error {
+	v, err := d.tok.execute(p)
+	if err != nil {
+		return err
+	}
+	esc := d.esc
+	if !d.declared {
+		if inherited, ok := p.escaper(); ok {
+			esc = inherited
+		}
+	}
+	var str string
+	if esc == escape_none {
+		str, err = strValue(v)
 	} else {
-		return strValue(v)
+		str, err = escapeValue(v, esc)
 	}
+	if err != nil {
+		return newTypeError(d.tok.pos(), err)
+	}
+	_, err = io.WriteString(w, str)
+
+	return err
 }
 
-func (d *assignDirect) execute(p Params) (string, error) {
+func (d *assignDirect) execute(w io.Writer, p Params) error {
 	yx, err := d.rh.execute(p)
 	if err != nil {
-		return "", err
+		return err
 	}
 	p[d.lh.name.value] = yx.Interface()
 
-	return "", nil
+	return nil
 }
 
-func (d *sectionDirect) execute(p Params) (string, error) {
-	sb := &strings.Builder{}
+func (d *sectionDirect) execute(w io.Writer, p Params) error {
 	for _, x := range d.list {
-		if str, err := x.execute(p); err != nil {
-			return "", err
-		} else {
-			sb.WriteString(str)
+		if err := x.execute(w, p); err != nil {
+			return err
 		}
 	}
 
-	return sb.String(), nil
+	return nil
 }
 
-func (d *ifDirect) execute(p Params) (string, error) {
+func (d *ifDirect) execute(w io.Writer, p Params) error {
 	if conv, err := d.cond.execute(p); err != nil {
-		return "", err
+		return err
 	} else {
 		if truth, err := boolValue(conv); err != nil {
-			return "", err
+			return newTypeError(d.cond.pos(), err)
 		} else if truth {
-			return d.body.execute(p)
+			return d.body.execute(w, p)
 		} else if d.el != nil {
-			return d.el.execute(p)
+			return d.el.execute(w, p)
 		}
 
-		return "", nil
+		return nil
 	}
 }
 
-func (d *forDirect) execute(p Params) (string, error) {
-	var (
-		str string
-		err error
-		v   reflect.Value
-	)
-	v, err = d.x.execute(p)
+func (d *forDirect) execute(w io.Writer, p Params) error {
+	v, err := d.x.execute(p)
 	if err != nil {
-		return "", nil
+		return err
+	}
+	next, length, stop, err := iterate(p.context(), p.engine().compares, uncoverInterface(v), d.key != nil)
+	defer stop()
+	if err != nil {
+		return newTypeError(d.x.pos(), err)
 	}
-	sb := &strings.Builder{}
-	v = uncoverInterface(v)
 	np := cop(p)
-	switch v.Kind() {
-	case reflect.Map:
-		iter := v.MapRange()
-		for iter.Next() {
-			if d.key != nil {
-				np[d.key.name.value] = iter.Key().Interface()
+	if d.cond != nil {
+		next = d.filter(next, cop(p))
+		if length >= 0 {
+			kept, err := collect(next)
+			if err != nil {
+				return err
 			}
-			np[d.value.name.value] = iter.Value().Interface()
-			if str, err = d.body.execute(np); err != nil {
-				return "", err
-			} else {
-				sb.WriteString(str)
+			next, length = items(kept), len(kept)
+		}
+	}
+	parent, _ := p[loop_name].(*Loop)
+	loop := newLoop(length, parent)
+	if d.loop {
+		np[loop_name] = loop
+	}
+	for {
+		item, ok, err := next()
+		if err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+		d.bind(np, item)
+		if more, err := d.next(w, np, loop); !more {
+			if err != nil {
+				return err
 			}
+			break
 		}
+	}
+	if err = np.interrupted(d.value.name, "for loop", ""); err != nil {
+		return err
+	}
+	if loop.index0 == 0 && d.el != nil {
+		return d.el.execute(w, p)
+	}
 
-	case reflect.Slice, reflect.Array, reflect.String:
-		for i := 0; i < v.Len(); i++ {
-			if d.key != nil {
-				np[d.key.name.value] = i
+	return nil
+}
+
+func (d *forDirect) bind(p Params, item forItem) {
+	if d.key != nil {
+		p[d.key.name.value] = item.key
+	}
+	p[d.value.name.value] = item.value
+}
+
+// filter returns the func pulling the items for which the condition of the
+// loop is true.
+func (d *forDirect) filter(next nextFunc, p Params) nextFunc {
+	return func() (forItem, bool, error) {
+		for {
+			item, ok, err := next()
+			if err != nil || !ok {
+				return item, ok, err
 			}
-			np[d.value.name.value] = v.Index(i).Interface()
-			if str, err = d.body.execute(np); err != nil {
-				return "", err
-			} else {
-				sb.WriteString(str)
+			d.bind(p, item)
+			conv, err := d.cond.execute(p)
+			if err != nil {
+				return item, false, err
+			}
+			truth, err := boolValue(conv)
+			if err != nil {
+				return item, false, newTypeError(d.cond.pos(), err)
+			}
+			if truth {
+				return item, true, nil
 			}
 		}
+	}
+}
 
-	default:
-		return "", errors.Errorf("can't iter type %s", v.Type())
+// next runs the body for the current item of loop, more reports whether the
+// loop goes on.
+func (d *forDirect) next(w io.Writer, p Params, loop *Loop) (more bool, err error) {
+	if err = p.interrupted(d.value.name, "for loop", ""); err != nil {
+		return false, err
+	}
+	err = d.body.execute(w, p)
+	loop.index0++
+	switch err {
+	case nil, errContinue:
+		return true, nil
+	case errBreak:
+		return false, nil
 	}
 
-	return sb.String(), nil
+	return false, err
 }
 
-func (d *blockDirect) execute(p Params) (string, error) {
-	sb := &strings.Builder{}
-	var (
-		str string
-		err error
-	)
-	if d.body != nil {
-		for _, v := range d.body.list {
-			if str, err = v.execute(p); err != nil {
-				return "", err
-			} else {
-				sb.WriteString(str)
-			}
-		}
+func (d *breakDirect) execute(w io.Writer, p Params) error {
+	return jump(d.cond, p, errBreak)
+}
+
+func (d *continueDirect) execute(w io.Writer, p Params) error {
+	return jump(d.cond, p, errContinue)
+}
+
+// jump returns sentinel, which stops the enclosing loop or its current
+// iteration, if cond is nil or true.
+func jump(cond expr, p Params, sentinel error) error {
+	if cond == nil {
+		return sentinel
+	}
+	conv, err := cond.execute(p)
+	if err != nil {
+		return err
+	}
+	truth, err := boolValue(conv)
+	if err != nil {
+		return newTypeError(cond.pos(), err)
+	}
+	if truth {
+		return sentinel
 	}
 
+	return nil
+}
+
+func (d *blockDirect) execute(w io.Writer, p Params) error {
+	if err := p.interrupted(d.name.value, "block", d.name.value.value); err != nil {
+		return err
+	}
+	// The body of an overridden block is still rendered, it's exposed to the
+	// overriding block as its parent content.
 	if b := p.getBlock(d.name.value.value); b != nil && b != d {
+		sb := &strings.Builder{}
+		if d.body != nil {
+			if err := d.body.execute(sb, p); err != nil {
+				return err
+			}
+		}
 		np := cop(p)
 		np.setBlockRemains(sb.String())
 
-		return b.execute(np)
+		return b.execute(w, np)
 	}
 
-	return sb.String(), nil
+	if d.body != nil {
+		return d.body.execute(w, p)
+	}
+
+	return nil
 }
 
-func (d *includeDirect) execute(p Params) (string, error) {
+func (d *includeDirect) execute(w io.Writer, p Params) error {
+	if err := p.interrupted(d.path.value, "include", d.path.value.value); err != nil {
+		return err
+	}
 	if d.params != nil {
 		val, err := d.params.execute(p)
 		if err != nil {
-			return "", err
+			return err
 		}
 		if val.Type() != reflect.TypeOf(p) {
-			return "", errors.Errorf("can't use type %s as params", val.Type())
+			return newTypeError(d.params.pos(), errors.Errorf("can't use type %s as params", val.Type()))
 		}
 		np := val.Interface().(Params)
 		if d.only {
-			return d.doc.execute(np)
+			np = cop(np)
+			p.inherit(np)
+
+			return enter(d.doc.execute(w, np), "include", d.path.value)
 		}
 		np = cop(p)
 		for k, v := range val.Interface().(Params) {
 			np[k] = v
 		}
 
-		return d.doc.execute(np)
+		return enter(d.doc.execute(w, np), "include", d.path.value)
 	}
 
-	return d.doc.execute(p)
+	return enter(d.doc.execute(w, p), "include", d.path.value)
 }
 
-func (d *extendDirect) execute(p Params) (string, error) {
+func (d *macroDirect) execute(w io.Writer, p Params) error {
+	return nil
+}
+
+// call renders the macro with argv in a scope of its own, the output is safe.
+func (d *macroDirect) call(p Params, argv []reflect.Value) (reflect.Value, error) {
+	if err := p.interrupted(d.name, "macro", d.name.value); err != nil {
+		return zeroValue, err
+	}
+	if len(argv) > len(d.params) {
+		return zeroValue, errors.Errorf("wrong number of args of macro %s: got %d want at most %d", d.name.value, len(argv), len(d.params))
+	}
+	np := make(Params)
+	np.setEngine(d.doc.engine)
+	np.setContext(p.context())
+	np.setMacros(d.doc.macros)
+	d.doc.imports(np)
+	for i, param := range d.params {
+		switch {
+		case i < len(argv):
+			if arg := uncoverInterface(argv[i]); arg.IsValid() {
+				np[param.name.value] = arg.Interface()
+			} else {
+				np[param.name.value] = nil
+			}
+		case d.defaults[i] != nil:
+			v, err := d.defaults[i].execute(np)
+			if err != nil {
+				return zeroValue, err
+			}
+			np[param.name.value] = v.Interface()
+		default:
+			return zeroValue, errors.Errorf("missing arg %s of macro %s", param.name.value, d.name.value)
+		}
+	}
+	sb := &strings.Builder{}
+	if d.body != nil {
+		if err := d.body.execute(sb, np); err != nil {
+			return zeroValue, err
+		}
+	}
+
+	return reflect.ValueOf(SafeString(sb.String())), nil
+}
+
+func (d *importDirect) execute(w io.Writer, p Params) error {
+	d.bind(p)
+
+	return nil
+}
+
+// bind binds the alias of the import to the macros of the imported document.
+func (d *importDirect) bind(p Params) {
+	p[d.alias.name.value] = d.doc.macros
+}
+
+func (d *fromDirect) execute(w io.Writer, p Params) error {
+	d.bind(p)
+
+	return nil
+}
+
+// bind adds the imported macros to the macros in scope under their aliases.
+func (d *fromDirect) bind(p Params) {
+	macros := make(macroNamespace, len(d.names))
+	for i, name := range d.names {
+		macros[d.aliases[i].name.value] = d.doc.macros[name.name.value]
+	}
+	p.setMacros(macros)
+}
+
+func (d *autoescapeDirect) execute(w io.Writer, p Params) error {
+	if d.body == nil {
+		return nil
+	}
+	prev, ok := p[escaper_store_name]
+	p[escaper_store_name] = d.esc
+	err := d.body.execute(w, p)
+	if ok {
+		p[escaper_store_name] = prev
+	} else {
+		delete(p, escaper_store_name)
+	}
+
+	return err
+}
+
+func (d *extendDirect) execute(w io.Writer, p Params) error {
 	panic("unreachable")
 }
 
@@ -396,6 +680,17 @@ func boolValue(v reflect.Value) (bool, error) {
 
 func strValue(v reflect.Value) (string, error) {
 	v = uncoverInterface(v)
+	if !v.IsValid() {
+		return "", errors.New("can't convert nil to string")
+	}
+	switch v.Type() {
+	case timeType:
+		if v.CanInterface() {
+			return v.Interface().(time.Time).Format(time.RFC3339), nil
+		}
+	case durationType:
+		return time.Duration(v.Int()).String(), nil
+	}
 	kind := v.Kind()
 	if isIntLike(kind) {
 		return strconv.Itoa(int(v.Int())), nil
@@ -0,0 +1,485 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// itemsOf returns the items of the slice, array or map v the way a for loop
+// ranges over them, or the runes of the string v. Unlike for loops, numbers,
+// channels and iterators are refused.
+func itemsOf(cm *compareMap, v any) ([]forItem, error) {
+	x := uncoverInterface(reflect.ValueOf(v))
+	switch x.Kind() {
+	case reflect.String:
+		var list []forItem
+		for i, r := range []rune(x.String()) {
+			list = append(list, forItem{i, string(r)})
+		}
+		return list, nil
+	case reflect.Slice, reflect.Array, reflect.Map:
+	case reflect.Invalid:
+		return nil, errors.New("can't use nil as list")
+	default:
+		return nil, errors.Errorf("can't use type %s as list", x.Type())
+	}
+	next, _, stop, err := iterate(nil, cm, x, true)
+	defer stop()
+	if err != nil {
+		return nil, err
+	}
+
+	return collect(next)
+}
+
+// listOf returns the values of the items of v.
+func listOf(cm *compareMap, v any) ([]any, error) {
+	list, err := itemsOf(cm, v)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, len(list))
+	for i, item := range list {
+		values[i] = item.value
+	}
+
+	return values, nil
+}
+
+// attr returns the value at the dotted path of item, such as "user.name" or
+// "tags.0"; item itself if path is empty.
+func attr(item any, path string) (any, error) {
+	if path == "" {
+		return item, nil
+	}
+	v := reflect.ValueOf(item)
+	for _, name := range strings.Split(path, ".") {
+		v = uncoverInterface(v)
+		if !v.IsValid() {
+			return nil, errors.Errorf("can't get %s of nil", path)
+		}
+		var key any = name
+		if k := v.Kind(); k == reflect.Slice || k == reflect.Array || k == reflect.String {
+			if i, err := strconv.Atoi(name); err == nil {
+				key = i
+			}
+		}
+		x, err := get(v.Interface(), key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't get %s", path)
+		}
+		v = x
+	}
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, nil
+	}
+
+	return v.Interface(), nil
+}
+
+// attrs returns the value at path of each item of v.
+func attrs(cm *compareMap, v any, path ...string) ([]any, error) {
+	list, err := listOf(cm, v)
+	if err != nil || len(path) == 0 {
+		return list, err
+	}
+	for i, item := range list {
+		if list[i], err = attr(item, path[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+// equal reports whether x and y are equal the way the == operator tells.
+func equal(x, y any) bool {
+	vx, vy := reflect.ValueOf(x), reflect.ValueOf(y)
+	if !vx.IsValid() || !vy.IsValid() {
+		return vx.IsValid() == vy.IsValid()
+	}
+	r, err := eq(vx, vy)
+
+	return err == nil && r.Bool()
+}
+
+// first returns the first item of v; or nil if it's empty.
+func first(cm *compareMap, v any) (any, error) {
+	list, err := listOf(cm, v)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+
+	return list[0], nil
+}
+
+// last returns the last item of v; or nil if it's empty.
+func last(cm *compareMap, v any) (any, error) {
+	list, err := listOf(cm, v)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+
+	return list[len(list)-1], nil
+}
+
+// join concatenates the items of v, separated by sep.
+func join(cm *compareMap, v any, sep ...string) (string, error) {
+	list, err := listOf(cm, v)
+	if err != nil {
+		return "", err
+	}
+	strs := make([]string, len(list))
+	for i, item := range list {
+		if strs[i], err = str(item); err != nil {
+			return "", err
+		}
+	}
+
+	return strings.Join(strs, strings.Join(sep, "")), nil
+}
+
+// reverse returns the items of v in reverse order, or the reversed string if
+// v is a string.
+func reverse(cm *compareMap, v any) (any, error) {
+	list, err := listOf(cm, v)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	if uncoverInterface(reflect.ValueOf(v)).Kind() == reflect.String {
+		return join(cm, list)
+	}
+
+	return list, nil
+}
+
+// sortList returns the items of v sorted by value, or by the value at path.
+func sortList(cm *compareMap, v any, path ...string) ([]any, error) {
+	list, err := listOf(cm, v)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := attrs(cm, list, path...)
+	if err != nil {
+		return nil, err
+	}
+	index := make([]int, len(list))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(i, j int) bool {
+		return cm.order(keys[index[i]], keys[index[j]]) < 0
+	})
+	sorted := make([]any, len(list))
+	for i, k := range index {
+		sorted[i] = list[k]
+	}
+
+	return sorted, nil
+}
+
+// slice returns length items of v, or all of them, from start. A negative
+// start counts from the end, and a negative length leaves as many items out
+// of the end. Strings are sliced by runes.
+func slice(cm *compareMap, v any, start int, length ...int) (any, error) {
+	list, err := listOf(cm, v)
+	if err != nil {
+		return nil, err
+	}
+	n := len(list)
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	start = min(start, n)
+	end := n
+	if len(length) > 0 {
+		if length[0] < 0 {
+			end = max(n+length[0], start)
+		} else {
+			end = min(start+length[0], n)
+		}
+	}
+	if x := uncoverInterface(reflect.ValueOf(v)); x.Kind() == reflect.String {
+		return string([]rune(x.String())[start:end]), nil
+	}
+
+	return list[start:end], nil
+}
+
+// batch splits the items of v into lists of size items, the last one is
+// completed with fill if it's given.
+func batch(cm *compareMap, v any, size int, fill ...any) ([][]any, error) {
+	if size <= 0 {
+		return nil, errors.Errorf("can't batch items by %d", size)
+	}
+	list, err := listOf(cm, v)
+	if err != nil {
+		return nil, err
+	}
+	var batches [][]any
+	for i := 0; i < len(list); i += size {
+		b := list[i:min(i+size, len(list))]
+		if len(b) < size && len(fill) > 0 {
+			b = append(b[:len(b):len(b)], make([]any, size-len(b))...)
+			for j := len(list) - i; j < size; j++ {
+				b[j] = fill[0]
+			}
+		}
+		batches = append(batches, b)
+	}
+
+	return batches, nil
+}
+
+// unique returns the items of v without the duplicated ones, or without the
+// ones having the same value at path.
+func unique(cm *compareMap, v any, path ...string) ([]any, error) {
+	list, err := listOf(cm, v)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := attrs(cm, list, path...)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		kept []any
+		seen = make(map[any]bool)
+	)
+	for i, item := range list {
+		if key := mapKey(keys[i]); !seen[key] {
+			seen[key] = true
+			kept = append(kept, item)
+		}
+	}
+
+	return kept, nil
+}
+
+// mapKey returns k as a key of a Go map, values which can't be compared are
+// told apart by their type and formatted value.
+func mapKey(k any) any {
+	if k == nil || reflect.TypeOf(k).Comparable() {
+		return k
+	}
+
+	return fmt.Sprintf("%T:%v", k, k)
+}
+
+// keys returns the keys of the map v sorted, or the indexes of the list v.
+func keys(cm *compareMap, v any) ([]any, error) {
+	list, err := itemsOf(cm, v)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]any, len(list))
+	for i, item := range list {
+		keys[i] = item.key
+	}
+
+	return keys, nil
+}
+
+// values returns the values of the map v sorted by key, or the items of the
+// list v.
+func values(cm *compareMap, v any) ([]any, error) {
+	return listOf(cm, v)
+}
+
+// merge returns the entries of the map x updated by the ones of the map y, or
+// the items of the list x followed by the ones of y.
+func merge(cm *compareMap, x, y any) (any, error) {
+	vx, vy := uncoverInterface(reflect.ValueOf(x)), uncoverInterface(reflect.ValueOf(y))
+	if vx.Kind() != reflect.Map {
+		lx, err := listOf(cm, x)
+		if err != nil {
+			return nil, err
+		}
+		ly, err := listOf(cm, y)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(lx, ly...), nil
+	}
+	if vy.Kind() != reflect.Map {
+		return nil, errors.Errorf("can't merge %T into a map", y)
+	}
+	typ := vx.Type()
+	m := reflect.MakeMapWithSize(typ, vx.Len()+vy.Len())
+	for _, v := range []reflect.Value{vx, vy} {
+		iter := v.MapRange()
+		for iter.Next() {
+			k, err := prepareValueType(iter.Key(), typ.Key())
+			if err != nil {
+				return nil, errors.Wrap(err, "can't merge map key")
+			}
+			e, err := prepareValueType(iter.Value(), typ.Elem())
+			if err != nil {
+				return nil, errors.Wrap(err, "can't merge map value")
+			}
+			m.SetMapIndex(k, e)
+		}
+	}
+
+	return m.Interface(), nil
+}
+
+// groupby groups the items of v by their value at path, the groups are
+// ranged over by for loops sorted by that value, such as
+// {% for city, users in users|groupby("address.city") %}.
+func groupby(cm *compareMap, v any, path string) (sortedMap, error) {
+	list, err := listOf(cm, v)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		groups sortedMap
+		index  = make(map[any]int)
+	)
+	for _, item := range list {
+		key, err := attr(item, path)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := index[mapKey(key)]
+		if !ok {
+			i = len(groups)
+			index[mapKey(key)] = i
+			groups = append(groups, forItem{key: key, value: []any(nil)})
+		}
+		groups[i].value = append(groups[i].value.([]any), item)
+	}
+	cm.sortItems(groups)
+
+	return groups, nil
+}
+
+// mapAttr returns the value at path of each item of v.
+func mapAttr(cm *compareMap, v any, path string) ([]any, error) {
+	return attrs(cm, v, path)
+}
+
+// selectattr returns the items of v having a true value at path, or a value
+// equal to value if it's given.
+func selectattr(cm *compareMap, v any, path string, value ...any) ([]any, error) {
+	return filterAttr(cm, v, path, value, true)
+}
+
+// rejectattr returns the items of v which selectattr leaves out.
+func rejectattr(cm *compareMap, v any, path string, value ...any) ([]any, error) {
+	return filterAttr(cm, v, path, value, false)
+}
+
+func filterAttr(cm *compareMap, v any, path string, value []any, keep bool) ([]any, error) {
+	list, err := listOf(cm, v)
+	if err != nil {
+		return nil, err
+	}
+	var kept []any
+	for _, item := range list {
+		x, err := attr(item, path)
+		if err != nil {
+			return nil, err
+		}
+		var truth bool
+		if len(value) > 0 {
+			truth = equal(x, value[0])
+		} else if x != nil {
+			if truth, err = boolValue(reflect.ValueOf(x)); err != nil {
+				return nil, err
+			}
+		}
+		if truth == keep {
+			kept = append(kept, item)
+		}
+	}
+
+	return kept, nil
+}
+
+// sum adds up the items of v, or their values at path.
+func sum(cm *compareMap, v any, path ...string) (any, error) {
+	list, err := attrs(cm, v, path...)
+	if err != nil {
+		return nil, err
+	}
+	total := reflect.ValueOf(0)
+	for _, item := range list {
+		if total, err = add(total, reflect.ValueOf(item)); err != nil {
+			return nil, err
+		}
+	}
+
+	return total.Interface(), nil
+}
+
+// minOf returns the least item of v, or the one having the least value at
+// path; nil if v is empty.
+func minOf(cm *compareMap, v any, path ...string) (any, error) {
+	return extreme(cm, v, path, -1)
+}
+
+// maxOf returns the greatest item of v, or the one having the greatest value
+// at path; nil if v is empty.
+func maxOf(cm *compareMap, v any, path ...string) (any, error) {
+	return extreme(cm, v, path, 1)
+}
+
+func extreme(cm *compareMap, v any, path []string, sign int) (any, error) {
+	list, err := listOf(cm, v)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	keys, err := attrs(cm, list, path...)
+	if err != nil {
+		return nil, err
+	}
+	k := 0
+	for i := range list {
+		if cm.order(keys[i], keys[k])*sign > 0 {
+			k = i
+		}
+	}
+
+	return list[k], nil
+}
+
+// contains reports whether the string v contains x, the map v has the key x
+// or the list v has the item x.
+func contains(cm *compareMap, v any, x any) (bool, error) {
+	vv := uncoverInterface(reflect.ValueOf(v))
+	switch vv.Kind() {
+	case reflect.String:
+		s, err := str(x)
+		if err != nil {
+			return false, err
+		}
+		return strings.Contains(vv.String(), s), nil
+	case reflect.Map:
+		k, err := prepareValueType(reflect.ValueOf(x), vv.Type().Key())
+		if err != nil {
+			return false, nil
+		}
+		return vv.MapIndex(k).IsValid(), nil
+	}
+	list, err := listOf(cm, v)
+	if err != nil {
+		return false, err
+	}
+	for _, item := range list {
+		if equal(item, x) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
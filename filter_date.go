@@ -0,0 +1,234 @@
+package template
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	default_date_layout = "2006-01-02 15:04:05"
+	date_layouts        = [...]string{time.RFC3339Nano, default_date_layout, "2006-01-02"}
+
+	locations = &sync.Map{}
+
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// timeOf converts v into a time. Besides times, it takes unix timestamps in
+// seconds, and strings in RFC 3339, "2006-01-02 15:04:05" or "2006-01-02"
+// format.
+func timeOf(v any) (time.Time, error) {
+	x := uncoverInterface(reflect.ValueOf(v))
+	if x.Kind() == reflect.Pointer && !x.IsNil() {
+		x = x.Elem()
+	}
+	switch {
+	case !x.IsValid() || x.Kind() == reflect.Pointer:
+		return time.Time{}, errors.New("can't use nil as time")
+	case x.Type() == timeType:
+		return x.Interface().(time.Time), nil
+	case isIntLike(x.Kind()):
+		return time.Unix(x.Int(), 0).UTC(), nil
+	case isUintLike(x.Kind()):
+		return time.Unix(int64(x.Uint()), 0).UTC(), nil
+	case isFloat(x.Kind()):
+		sec, frac := math.Modf(x.Float())
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	case x.Kind() == reflect.String:
+		for _, layout := range date_layouts {
+			if t, err := time.Parse(layout, x.String()); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, errors.Errorf("can't use %q as time", x.String())
+	}
+
+	return time.Time{}, errors.Errorf("can't use type %s as time", x.Type())
+}
+
+// date formats v with format, either a Go layout such as "02/01/2006" or a
+// strftime format such as "%d/%m/%Y", "2006-01-02 15:04:05" by default.
+func date(v any, format ...string) (string, error) {
+	t, err := timeOf(v)
+	if err != nil {
+		return "", err
+	}
+	layout := default_date_layout
+	if len(format) > 0 {
+		layout = format[0]
+	}
+	if strings.Contains(layout, "%") {
+		return strftime(t, layout)
+	}
+
+	return t.Format(layout), nil
+}
+
+// strftime formats t with the strftime format f.
+func strftime(t time.Time, f string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			sb.WriteByte(f[i])
+			continue
+		}
+		if i++; i == len(f) {
+			return "", errors.Errorf("incomplete directive at the end of %q", f)
+		}
+		switch f[i] {
+		case 'a':
+			sb.WriteString(t.Format("Mon"))
+		case 'A':
+			sb.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			sb.WriteString(t.Format("Jan"))
+		case 'B':
+			sb.WriteString(t.Format("January"))
+		case 'c':
+			sb.WriteString(t.Format(time.ANSIC))
+		case 'C':
+			sb.WriteString(pad(t.Year()/100, 2, '0'))
+		case 'd':
+			sb.WriteString(t.Format("02"))
+		case 'D':
+			sb.WriteString(t.Format("01/02/06"))
+		case 'e':
+			sb.WriteString(t.Format("_2"))
+		case 'f':
+			sb.WriteString(pad(t.Nanosecond()/1000, 6, '0'))
+		case 'F':
+			sb.WriteString(t.Format("2006-01-02"))
+		case 'H':
+			sb.WriteString(t.Format("15"))
+		case 'I':
+			sb.WriteString(t.Format("03"))
+		case 'j':
+			sb.WriteString(pad(t.YearDay(), 3, '0'))
+		case 'k':
+			sb.WriteString(pad(t.Hour(), 2, ' '))
+		case 'l':
+			sb.WriteString(pad((t.Hour()+11)%12+1, 2, ' '))
+		case 'm':
+			sb.WriteString(t.Format("01"))
+		case 'M':
+			sb.WriteString(t.Format("04"))
+		case 'n':
+			sb.WriteByte('\n')
+		case 'p':
+			sb.WriteString(t.Format("PM"))
+		case 'R':
+			sb.WriteString(t.Format("15:04"))
+		case 's':
+			sb.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'S':
+			sb.WriteString(t.Format("05"))
+		case 't':
+			sb.WriteByte('\t')
+		case 'T':
+			sb.WriteString(t.Format("15:04:05"))
+		case 'u':
+			sb.WriteString(strconv.Itoa((int(t.Weekday())+6)%7 + 1))
+		case 'w':
+			sb.WriteString(strconv.Itoa(int(t.Weekday())))
+		case 'y':
+			sb.WriteString(t.Format("06"))
+		case 'Y':
+			sb.WriteString(strconv.Itoa(t.Year()))
+		case 'z':
+			sb.WriteString(t.Format("-0700"))
+		case 'Z':
+			sb.WriteString(t.Format("MST"))
+		case '%':
+			sb.WriteByte('%')
+		default:
+			return "", errors.Errorf("unknown directive %%%c in %q", f[i], f)
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// pad formats n with at least width digits, padded on the left with c.
+func pad(n, width int, c byte) string {
+	s := strconv.Itoa(n)
+	if len(s) >= width {
+		return s
+	}
+
+	return strings.Repeat(string(c), width-len(s)) + s
+}
+
+// timezone converts v to the time zone named name, such as "Europe/Berlin",
+// "UTC" or "Local".
+func timezone(v any, name string) (time.Time, error) {
+	t, err := timeOf(v)
+	if err != nil {
+		return t, err
+	}
+	loc, ok := locations.Load(name)
+	if !ok {
+		if loc, err = time.LoadLocation(name); err != nil {
+			return t, errors.Errorf("unknown time zone %s", name)
+		}
+		locations.Store(name, loc)
+	}
+
+	return t.In(loc.(*time.Location)), nil
+}
+
+// timeago tells how long ago, or in how long, v is from now, such as
+// "3 minutes ago" or "in 2 days".
+func timeago(v any, now time.Time) (string, error) {
+	t, err := timeOf(v)
+	if err != nil {
+		return "", err
+	}
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+	var (
+		n    int64
+		unit string
+	)
+	switch day := 24 * time.Hour; {
+	case d < time.Minute:
+		return "just now", nil
+	case d < time.Hour:
+		n, unit = int64(d/time.Minute), "minute"
+	case d < day:
+		n, unit = int64(d/time.Hour), "hour"
+	case d < 30*day:
+		n, unit = int64(d/day), "day"
+	case d < 365*day:
+		n, unit = int64(d/(30*day)), "month"
+	default:
+		n, unit = int64(d/(365*day)), "year"
+	}
+	s := strconv.FormatInt(n, 10) + " " + unit
+	if n > 1 {
+		s += "s"
+	}
+	if future {
+		return "in " + s, nil
+	}
+
+	return s + " ago", nil
+}
+
+// times returns x and y as times if both of them are times.
+func times(x, y reflect.Value) (tx, ty time.Time, ok bool) {
+	if !x.IsValid() || !y.IsValid() || x.Type() != timeType || y.Type() != timeType {
+		return tx, ty, false
+	}
+
+	return x.Interface().(time.Time), y.Interface().(time.Time), true
+}
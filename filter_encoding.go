@@ -0,0 +1,222 @@
+package template
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"hash"
+	htmlTemplate "html/template"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var base64_encodings = [...]*base64.Encoding{
+	base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding,
+}
+
+// bytesOf converts the value a filter is applied to into bytes, byte slices
+// are taken as is.
+func bytesOf(v any) ([]byte, error) {
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	s, err := str(v)
+
+	return []byte(s), err
+}
+
+// jsonEncode encodes v as json, indented by indent spaces if it's given. <,
+// > and & are escaped, so that the json is written as is into scripts.
+func jsonEncode(v any, indent ...int) (htmlTemplate.JS, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if len(indent) > 0 && indent[0] > 0 {
+		enc.SetIndent("", strings.Repeat(" ", indent[0]))
+	}
+	if err := enc.Encode(v); err != nil {
+		return "", errors.Wrap(err, "can't encode json")
+	}
+
+	return htmlTemplate.JS(strings.TrimSuffix(buf.String(), "\n")), nil
+}
+
+// jsonDecode decodes the json v.
+func jsonDecode(v any) (any, error) {
+	b, err := bytesOf(v)
+	if err != nil {
+		return nil, err
+	}
+	var x any
+	if err := json.Unmarshal(b, &x); err != nil {
+		return nil, errors.Wrap(err, "can't decode json")
+	}
+
+	return x, nil
+}
+
+// urlEncode escapes v to be placed in a url query, or in a url path with the
+// flavor "path", where the segments are escaped one by one and the slashes
+// between them are kept. A map is encoded as a query string sorted by key,
+// such as {"q": "go", "tag": ["a", "b"]} for q=go&tag=a&tag=b.
+func urlEncode(cm *compareMap, v any, flavor ...string) (string, error) {
+	escape := url.QueryEscape
+	if len(flavor) > 0 {
+		switch flavor[0] {
+		case "query":
+		case "path":
+			escape = pathEscape
+		default:
+			return "", errors.Errorf("unknown url flavor %s; should be query or path", flavor[0])
+		}
+	}
+	if uncoverInterface(reflect.ValueOf(v)).Kind() != reflect.Map {
+		s, err := str(v)
+		return escape(s), err
+	}
+	entries, err := itemsOf(cm, v)
+	if err != nil {
+		return "", err
+	}
+	var params []string
+	for _, entry := range entries {
+		key, err := str(entry.key)
+		if err != nil {
+			return "", err
+		}
+		values := []any{entry.value}
+		if k := uncoverInterface(reflect.ValueOf(entry.value)).Kind(); k == reflect.Slice || k == reflect.Array {
+			if values, err = listOf(cm, entry.value); err != nil {
+				return "", err
+			}
+		}
+		for _, value := range values {
+			s, err := str(value)
+			if err != nil {
+				return "", errors.Wrapf(err, "can't encode %s", key)
+			}
+			params = append(params, escape(key)+"="+escape(s))
+		}
+	}
+
+	return strings.Join(params, "&"), nil
+}
+
+// pathEscape escapes the segments of the url path s, keeping the slashes.
+func pathEscape(s string) string {
+	segments := strings.Split(s, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// base64Encode encodes v with the standard base64 encoding, or the url safe
+// one if urlsafe is true.
+func base64Encode(v any, urlsafe ...bool) (string, error) {
+	b, err := bytesOf(v)
+	if err != nil {
+		return "", err
+	}
+	if len(urlsafe) > 0 && urlsafe[0] {
+		return base64.URLEncoding.EncodeToString(b), nil
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// base64Decode decodes v encoded with the standard or url safe base64
+// encoding, padded or not.
+func base64Decode(v any) (string, error) {
+	s, err := str(v)
+	if err != nil {
+		return "", err
+	}
+	for _, enc := range base64_encodings {
+		if b, err := enc.DecodeString(s); err == nil {
+			return string(b), nil
+		}
+	}
+
+	return "", errors.Errorf("can't decode %q as base64", s)
+}
+
+// xmlEscape escapes v to be placed in xml text or attribute values.
+func xmlEscape(v any) (SafeString, error) {
+	s, err := str(v)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(s))
+
+	return SafeString(sb.String()), nil
+}
+
+// csvEscape quotes v as a csv field if needed, or joins the fields of the
+// list v into a csv line.
+func csvEscape(cm *compareMap, v any, sep ...string) (string, error) {
+	var values []any
+	if k := uncoverInterface(reflect.ValueOf(v)).Kind(); k == reflect.Slice || k == reflect.Array {
+		var err error
+		if values, err = listOf(cm, v); err != nil {
+			return "", err
+		}
+	} else {
+		values = []any{v}
+	}
+	fields := make([]string, len(values))
+	for i, value := range values {
+		var err error
+		if fields[i], err = str(value); err != nil {
+			return "", err
+		}
+	}
+	var sb strings.Builder
+	w := csv.NewWriter(&sb)
+	if len(sep) > 0 {
+		if r := []rune(sep[0]); len(r) == 1 {
+			w.Comma = r[0]
+		} else {
+			return "", errors.Errorf("can't use %q as csv separator", sep[0])
+		}
+	}
+	if err := w.Write(fields); err != nil {
+		return "", errors.Wrap(err, "can't write csv")
+	}
+	w.Flush()
+
+	return strings.TrimSuffix(sb.String(), "\n"), w.Error()
+}
+
+// digest returns the hex encoded checksum of v computed by h.
+func digest(h hash.Hash, v any) (string, error) {
+	b, err := bytesOf(v)
+	if err != nil {
+		return "", err
+	}
+	h.Write(b)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func md5Sum(v any) (string, error) {
+	return digest(md5.New(), v)
+}
+
+func sha1Sum(v any) (string, error) {
+	return digest(sha1.New(), v)
+}
+
+func sha256Sum(v any) (string, error) {
+	return digest(sha256.New(), v)
+}
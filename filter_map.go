@@ -7,12 +7,12 @@ import (
 	"github.com/pkg/errors"
 )
 
-var (
-	filter_map = &filterMap{
+func newFilterMap() *filterMap {
+	return &filterMap{
 		store:  buildInFilters(),
 		locker: &sync.RWMutex{},
 	}
-)
+}
 
 type filterMap struct {
 	store  map[string]reflect.Value
@@ -20,6 +20,10 @@ type filterMap struct {
 }
 
 func RegisterFilter(name string, fn any) error {
+	return defaultEngine.RegisterFilter(name, fn)
+}
+
+func (fm *filterMap) register(name string, fn any) error {
 	if fn == nil {
 		return nil
 	}
@@ -33,21 +37,31 @@ func RegisterFilter(name string, fn any) error {
 	if !goodFunc(fnValue.Type()) {
 		return errors.Errorf("filter return %d values; should be 1 or 2", fnValue.Type().NumOut())
 	}
-	filter_map.locker.Lock()
-	defer filter_map.locker.Unlock()
+	fm.locker.Lock()
+	defer fm.locker.Unlock()
 
-	filter_map.store[name] = fnValue
+	fm.store[name] = fnValue
 
 	return nil
 }
 
-func getFilter(name string) reflect.Value {
-	filter_map.locker.RLock()
-	defer filter_map.locker.RUnlock()
+func (fm *filterMap) get(name string) reflect.Value {
+	fm.locker.RLock()
+	defer fm.locker.RUnlock()
 
-	if fn, ok := filter_map.store[name]; ok {
+	if fn, ok := fm.store[name]; ok {
 		return fn
 	}
 
 	return zeroValue
 }
+
+// callFilter calls filter with argv, the filters ordering values are handed
+// the compareMap of e first.
+func (e *Engine) callFilter(filter reflect.Value, argv ...reflect.Value) (reflect.Value, error) {
+	if typ := filter.Type(); typ.NumIn() > 0 && typ.In(0) == compareMapType {
+		argv = append([]reflect.Value{reflect.ValueOf(e.compares)}, argv...)
+	}
+
+	return call(filter, argv...)
+}
@@ -0,0 +1,267 @@
+package template
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	decimal_units = [...]string{"KB", "MB", "GB", "TB", "PB", "EB", "ZB", "YB"}
+	binary_units  = [...]string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB", "ZiB", "YiB"}
+)
+
+// number converts the value a filter is applied to into a float64, numeric
+// strings are parsed.
+func number(v any) (float64, error) {
+	x := uncoverInterface(reflect.ValueOf(v))
+	switch {
+	case !x.IsValid():
+		return 0, errors.New("can't use nil as number")
+	case isIntLike(x.Kind()):
+		return float64(x.Int()), nil
+	case isUintLike(x.Kind()):
+		return float64(x.Uint()), nil
+	case isFloat(x.Kind()):
+		return x.Float(), nil
+	case x.Kind() == reflect.String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x.String()), 64)
+		if err != nil {
+			return 0, errors.Errorf("can't use %q as number", x.String())
+		}
+		return f, nil
+	}
+
+	return 0, errors.Errorf("can't use type %s as number", x.Type())
+}
+
+// intArg returns the i-th optional argument of a filter as an int, or def.
+func intArg(args []any, i int, def int) (int, error) {
+	if i >= len(args) {
+		return def, nil
+	}
+	v, err := prepareValueType(reflect.ValueOf(args[i]), reflect.TypeOf(def))
+	if err != nil {
+		return 0, errors.Wrapf(err, "arg %d", i+1)
+	}
+
+	return int(v.Int()), nil
+}
+
+// strArg returns the i-th optional argument of a filter as a string, or def.
+func strArg(args []any, i int, def string) (string, error) {
+	if i >= len(args) {
+		return def, nil
+	}
+	s, ok := args[i].(string)
+	if !ok {
+		return "", errors.Errorf("arg %d: value has type %T; should be string", i+1, args[i])
+	}
+
+	return s, nil
+}
+
+// roundTo rounds x to precision decimals, half away from zero by default, or
+// up with "ceil" and down with "floor". x is rounded as written in decimal,
+// so that 1.005 is rounded to 1.01.
+func roundTo(x float64, precision int, method string) (float64, error) {
+	var fn func(float64) float64
+	switch method {
+	case "common":
+		fn = math.Round
+	case "ceil":
+		fn = math.Ceil
+	case "floor":
+		fn = math.Floor
+	default:
+		return 0, errors.Errorf("unknown round method %s; should be common, ceil or floor", method)
+	}
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return x, nil
+	}
+
+	return shift(fn(shift(x, precision)), -precision), nil
+}
+
+// shift multiplies x by 10 to the power of n, without the error of a float
+// multiplication.
+func shift(x float64, n int) float64 {
+	mantissa, exp, _ := strings.Cut(strconv.FormatFloat(x, 'e', -1, 64), "e")
+	e, _ := strconv.Atoi(exp)
+	x, _ = strconv.ParseFloat(mantissa+"e"+strconv.Itoa(e+n), 64)
+
+	return x
+}
+
+// round rounds v to precision decimals, 0 by default, with the method
+// common, the default, ceil or floor, such as round(2, "floor").
+func round(v any, args ...any) (float64, error) {
+	x, err := number(v)
+	if err != nil {
+		return 0, err
+	}
+	precision, err := intArg(args, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	method, err := strArg(args, 1, "common")
+	if err != nil {
+		return 0, err
+	}
+
+	return roundTo(x, precision, method)
+}
+
+// abs returns the absolute value of v, keeping its type.
+func abs(v any) (any, error) {
+	x := uncoverInterface(reflect.ValueOf(v))
+	switch {
+	case !x.IsValid():
+		return nil, errors.New("can't use nil as number")
+	case isIntLike(x.Kind()):
+		if x.Int() < 0 {
+			y := reflect.New(x.Type()).Elem()
+			y.SetInt(-x.Int())
+			return y.Interface(), nil
+		}
+		return x.Interface(), nil
+	case isUintLike(x.Kind()):
+		return x.Interface(), nil
+	}
+	f, err := number(v)
+
+	return math.Abs(f), err
+}
+
+// floor returns the greatest integer value less than or equal to v.
+func floor(v any) (float64, error) {
+	x, err := number(v)
+
+	return math.Floor(x), err
+}
+
+// ceil returns the least integer value greater than or equal to v.
+func ceil(v any) (float64, error) {
+	x, err := number(v)
+
+	return math.Ceil(x), err
+}
+
+// numberFormat formats v with decimals decimals, 0 by default, the decimal
+// point dec_point, "." by default, and the thousands separator thousands_sep,
+// "," by default, such as number_format(2, ",", " ").
+func numberFormat(v any, args ...any) (string, error) {
+	x, err := number(v)
+	if err != nil {
+		return "", err
+	}
+	decimals, err := intArg(args, 0, 0)
+	if err != nil {
+		return "", err
+	}
+	point, err := strArg(args, 1, ".")
+	if err != nil {
+		return "", err
+	}
+	sep, err := strArg(args, 2, ",")
+	if err != nil {
+		return "", err
+	}
+	if x, err = roundTo(x, decimals, "common"); err != nil {
+		return "", err
+	}
+	s := strconv.FormatFloat(math.Abs(x), 'f', max(decimals, 0), 64)
+	whole, frac, _ := strings.Cut(s, ".")
+	var sb strings.Builder
+	if x < 0 {
+		sb.WriteByte('-')
+	}
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			sb.WriteString(sep)
+		}
+		sb.WriteRune(r)
+	}
+	if frac != "" {
+		sb.WriteString(point)
+		sb.WriteString(frac)
+	}
+
+	return sb.String(), nil
+}
+
+// percent formats the ratio v as a percentage with decimals decimals, 0 by
+// default, such as 0.256|percent(1) for 25.6%.
+func percent(v any, decimals ...int) (string, error) {
+	x, err := number(v)
+	if err != nil {
+		return "", err
+	}
+	precision := 0
+	if len(decimals) > 0 {
+		precision = max(decimals[0], 0)
+	}
+	if x, err = roundTo(shift(x, 2), precision, "common"); err != nil {
+		return "", err
+	}
+
+	return strconv.FormatFloat(x, 'f', precision, 64) + "%", nil
+}
+
+// filesizeformat formats the number of bytes v in a human readable way, with
+// decimal units (KB, MB...) by default, or binary ones (KiB, MiB...).
+func filesizeformat(v any, binary ...bool) (string, error) {
+	x, err := number(v)
+	if err != nil {
+		return "", err
+	}
+	base, units := 1000.0, decimal_units[:]
+	if len(binary) > 0 && binary[0] {
+		base, units = 1024.0, binary_units[:]
+	}
+	switch {
+	case x == 1:
+		return "1 Byte", nil
+	case math.Abs(x) < base:
+		return strconv.FormatFloat(x, 'f', -1, 64) + " Bytes", nil
+	}
+	i := 0
+	for x /= base; math.Abs(x) >= base && i < len(units)-1; i++ {
+		x /= base
+	}
+
+	return strconv.FormatFloat(x, 'f', 1, 64) + " " + units[i], nil
+}
+
+// ordinal formats the integer v as an english ordinal number, such as 1st,
+// 2nd or 11th.
+func ordinal(v any) (string, error) {
+	x, err := number(v)
+	if err != nil {
+		return "", err
+	}
+	if x != math.Trunc(x) {
+		return "", errors.Errorf("can't use %v as ordinal number", x)
+	}
+	n := int64(x)
+	m := n % 100
+	if m < 0 {
+		m = -m
+	}
+	suffix := "th"
+	if m < 11 || m > 13 {
+		switch m % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+
+	return strconv.FormatInt(n, 10) + suffix, nil
+}
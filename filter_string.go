@@ -0,0 +1,284 @@
+package template
+
+import (
+	"fmt"
+	"html"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	reg_tag     = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+	reg_newline = regexp.MustCompile(`\r\n|\r|\n`)
+)
+
+// str converts the value a filter is applied to into a string.
+func str(v any) (string, error) {
+	return strValue(reflect.ValueOf(v))
+}
+
+func toUpper(v any) (string, error) {
+	s, err := str(v)
+
+	return strings.ToUpper(s), err
+}
+
+func toLower(v any) (string, error) {
+	s, err := str(v)
+
+	return strings.ToLower(s), err
+}
+
+// title upper cases the first letter of each word, and lower cases the others.
+func title(v any) (string, error) {
+	s, err := str(v)
+	if err != nil {
+		return "", err
+	}
+	rs := []rune(s)
+	start := true
+	for i, r := range rs {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' {
+			if start {
+				rs[i] = unicode.ToTitle(r)
+			} else {
+				rs[i] = unicode.ToLower(r)
+			}
+			start = false
+		} else {
+			start = true
+		}
+	}
+
+	return string(rs), nil
+}
+
+// capitalize upper cases the first letter of v, and lower cases the others.
+func capitalize(v any) (string, error) {
+	s, err := str(v)
+	if err != nil || s == "" {
+		return s, err
+	}
+	r, size := utf8.DecodeRuneInString(s)
+
+	return string(unicode.ToTitle(r)) + strings.ToLower(s[size:]), nil
+}
+
+// trim removes the leading and trailing white spaces of v, or the given
+// chars.
+func trim(v any, chars ...string) (string, error) {
+	s, err := str(v)
+	if len(chars) > 0 {
+		return strings.Trim(s, chars[0]), err
+	}
+
+	return strings.TrimSpace(s), err
+}
+
+func ltrim(v any, chars ...string) (string, error) {
+	s, err := str(v)
+	if len(chars) > 0 {
+		return strings.TrimLeft(s, chars[0]), err
+	}
+
+	return strings.TrimLeftFunc(s, unicode.IsSpace), err
+}
+
+func rtrim(v any, chars ...string) (string, error) {
+	s, err := str(v)
+	if len(chars) > 0 {
+		return strings.TrimRight(s, chars[0]), err
+	}
+
+	return strings.TrimRightFunc(s, unicode.IsSpace), err
+}
+
+// replace replaces old with new in v, only the first count ones if count is
+// given.
+func replace(v any, old, new string, count ...int) (string, error) {
+	s, err := str(v)
+	n := -1
+	if len(count) > 0 {
+		n = count[0]
+	}
+
+	return strings.Replace(s, old, new, n), err
+}
+
+// split splits v around sep, or around white spaces if sep isn't given.
+func split(v any, sep ...string) ([]string, error) {
+	s, err := str(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(sep) > 0 {
+		return strings.Split(s, sep[0]), nil
+	}
+
+	return strings.Fields(s), nil
+}
+
+// truncate cuts v down to length runes, the suffix, "..." by default,
+// included.
+func truncate(v any, length int, suffix ...string) (string, error) {
+	s, err := str(v)
+	if err != nil {
+		return "", err
+	}
+	end := "..."
+	if len(suffix) > 0 {
+		end = suffix[0]
+	}
+	rs := []rune(s)
+	if len(rs) <= length {
+		return s, nil
+	}
+	if n := utf8.RuneCountInString(end); length > n {
+		return string(rs[:length-n]) + end, nil
+	}
+
+	return string(rs[:max(length, 0)]), nil
+}
+
+// wordwrap breaks the lines of v at white spaces, so that they are at most
+// width runes long. Words longer than width are kept whole.
+func wordwrap(v any, width int, sep ...string) (string, error) {
+	s, err := str(v)
+	if err != nil {
+		return "", err
+	}
+	br := "\n"
+	if len(sep) > 0 {
+		br = sep[0]
+	}
+	lines := reg_newline.Split(s, -1)
+	for i, line := range lines {
+		var (
+			sb strings.Builder
+			n  int
+		)
+		for j, word := range strings.Fields(line) {
+			size := utf8.RuneCountInString(word)
+			switch {
+			case j == 0:
+			case n+1+size > width:
+				sb.WriteString(br)
+				n = 0
+			default:
+				sb.WriteByte(' ')
+				n++
+			}
+			sb.WriteString(word)
+			n += size
+		}
+		lines[i] = sb.String()
+	}
+
+	return strings.Join(lines, br), nil
+}
+
+// indent indents the lines of v but the first one, unless first is true, by
+// width spaces. Blank lines aren't indented.
+func indent(v any, width int, first ...bool) (string, error) {
+	s, err := str(v)
+	if err != nil {
+		return "", err
+	}
+	pad := strings.Repeat(" ", max(width, 0))
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if (i > 0 || len(first) > 0 && first[0]) && strings.TrimSpace(line) != "" {
+			lines[i] = pad + line
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// center pads v with spaces to width runes, the extra space goes right.
+func center(v any, width int) (string, error) {
+	s, err := str(v)
+	if err != nil {
+		return "", err
+	}
+	n := width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return s, nil
+	}
+
+	return strings.Repeat(" ", n/2) + s + strings.Repeat(" ", n-n/2), nil
+}
+
+// striptags removes the html tags and comments of v, unescapes its entities
+// and collapses its white spaces.
+func striptags(v any) (string, error) {
+	s, err := str(v)
+	if err != nil {
+		return "", err
+	}
+	s = html.UnescapeString(reg_tag.ReplaceAllString(s, " "))
+
+	return strings.Join(strings.Fields(s), " "), nil
+}
+
+// nl2br escapes v as html, unless it's safe, and inserts <br> before each of
+// its line breaks.
+func nl2br(v any) (SafeString, error) {
+	s, err := escapeValue(reflect.ValueOf(v), escape_html)
+	if err != nil {
+		return "", err
+	}
+
+	return SafeString(reg_newline.ReplaceAllStringFunc(s, func(br string) string {
+		return "<br>" + br
+	})), nil
+}
+
+// slugify lower cases v and joins its words, made of letters and digits, with
+// dashes.
+func slugify(v any) (string, error) {
+	s, err := str(v)
+	if err != nil {
+		return "", err
+	}
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	return strings.Join(words, "-"), nil
+}
+
+// format formats args according to the printf style layout v.
+func format(v any, args ...any) (string, error) {
+	layout, err := str(v)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(layout, args...), nil
+}
+
+// defaultTo returns def if v is nil or undefined, or if v is false, zero or
+// empty and boolean is true.
+func defaultTo(v any, def any, boolean ...bool) (any, error) {
+	x := uncoverInterface(reflect.ValueOf(v))
+	if !x.IsValid() {
+		return def, nil
+	}
+	if len(boolean) > 0 && boolean[0] {
+		truth, err := boolValue(x)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't tell if the value is empty")
+		}
+		if !truth {
+			return def, nil
+		}
+	}
+
+	return v, nil
+}
@@ -8,10 +8,81 @@ import (
 
 var filters = map[string]reflect.Value{
 	"length": reflect.ValueOf(length),
+	"raw":    reflect.ValueOf(raw),
+	"escape": reflect.ValueOf(escape),
+	"e":      reflect.ValueOf(escape),
+	"sortby": reflect.ValueOf(sortby),
+
+	"upper":      reflect.ValueOf(toUpper),
+	"lower":      reflect.ValueOf(toLower),
+	"title":      reflect.ValueOf(title),
+	"capitalize": reflect.ValueOf(capitalize),
+	"trim":       reflect.ValueOf(trim),
+	"ltrim":      reflect.ValueOf(ltrim),
+	"rtrim":      reflect.ValueOf(rtrim),
+	"replace":    reflect.ValueOf(replace),
+	"split":      reflect.ValueOf(split),
+	"truncate":   reflect.ValueOf(truncate),
+	"wordwrap":   reflect.ValueOf(wordwrap),
+	"indent":     reflect.ValueOf(indent),
+	"center":     reflect.ValueOf(center),
+	"striptags":  reflect.ValueOf(striptags),
+	"nl2br":      reflect.ValueOf(nl2br),
+	"slugify":    reflect.ValueOf(slugify),
+	"format":     reflect.ValueOf(format),
+	"default":    reflect.ValueOf(defaultTo),
+
+	"first":      reflect.ValueOf(first),
+	"last":       reflect.ValueOf(last),
+	"join":       reflect.ValueOf(join),
+	"reverse":    reflect.ValueOf(reverse),
+	"sort":       reflect.ValueOf(sortList),
+	"slice":      reflect.ValueOf(slice),
+	"batch":      reflect.ValueOf(batch),
+	"unique":     reflect.ValueOf(unique),
+	"keys":       reflect.ValueOf(keys),
+	"values":     reflect.ValueOf(values),
+	"merge":      reflect.ValueOf(merge),
+	"groupby":    reflect.ValueOf(groupby),
+	"map":        reflect.ValueOf(mapAttr),
+	"selectattr": reflect.ValueOf(selectattr),
+	"rejectattr": reflect.ValueOf(rejectattr),
+	"sum":        reflect.ValueOf(sum),
+	"min":        reflect.ValueOf(minOf),
+	"max":        reflect.ValueOf(maxOf),
+	"contains":   reflect.ValueOf(contains),
+
+	"round":          reflect.ValueOf(round),
+	"abs":            reflect.ValueOf(abs),
+	"floor":          reflect.ValueOf(floor),
+	"ceil":           reflect.ValueOf(ceil),
+	"number_format":  reflect.ValueOf(numberFormat),
+	"percent":        reflect.ValueOf(percent),
+	"filesizeformat": reflect.ValueOf(filesizeformat),
+	"ordinal":        reflect.ValueOf(ordinal),
+
+	"date":     reflect.ValueOf(date),
+	"timezone": reflect.ValueOf(timezone),
+
+	"json_encode":   reflect.ValueOf(jsonEncode),
+	"json_decode":   reflect.ValueOf(jsonDecode),
+	"url_encode":    reflect.ValueOf(urlEncode),
+	"base64_encode": reflect.ValueOf(base64Encode),
+	"base64_decode": reflect.ValueOf(base64Decode),
+	"xml_escape":    reflect.ValueOf(xmlEscape),
+	"csv_escape":    reflect.ValueOf(csvEscape),
+	"md5":           reflect.ValueOf(md5Sum),
+	"sha1":          reflect.ValueOf(sha1Sum),
+	"sha256":        reflect.ValueOf(sha256Sum),
 }
 
 func buildInFilters() map[string]reflect.Value {
-	return filters
+	store := make(map[string]reflect.Value, len(filters))
+	for name, fn := range filters {
+		store[name] = fn
+	}
+
+	return store
 }
 
 func length(i any) (int, error) {
@@ -23,3 +94,28 @@ func length(i any) (int, error) {
 
 	return 0, errors.Errorf("can't get length of type %s", iValue.Type())
 }
+
+// raw marks i as safe, so that it's written without escaping.
+func raw(i any) (SafeString, error) {
+	str, err := strValue(reflect.ValueOf(i))
+
+	return SafeString(str), err
+}
+
+// escape escapes i with strategy, html by default. The result is safe, so
+// it's never escaped again.
+func escape(i any, strategy ...string) (SafeString, error) {
+	esc := escape_html
+	if len(strategy) > 0 {
+		var ok bool
+		if esc, ok = escaperOf(strategy[0]); !ok {
+			return "", errors.Errorf("unknown escape strategy %s", strategy[0])
+		}
+	}
+	if esc == escape_none {
+		return raw(i)
+	}
+	str, err := escapeValue(reflect.ValueOf(i), esc)
+
+	return SafeString(str), err
+}
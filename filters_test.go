@@ -0,0 +1,385 @@
+package template
+
+import (
+	htmlTemplate "html/template"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type filterCase struct {
+	name     string
+	args     []any
+	expected any
+}
+
+// testFilters calls the built-in filters the way a pipeline does.
+func testFilters(t *testing.T, cases []filterCase) {
+	for _, c := range cases {
+		argv := make([]reflect.Value, len(c.args))
+		for i, arg := range c.args {
+			argv[i] = reflect.ValueOf(arg)
+		}
+		v, err := defaultEngine.callFilter(filters[c.name], argv...)
+		if assert.Nil(t, err, c.name, c.args) {
+			assert.Equal(t, c.expected, v.Interface(), c.name, c.args)
+		}
+	}
+}
+
+func TestStringFilters(t *testing.T) {
+	testFilters(t, []filterCase{
+		{"upper", []any{"héllo wörld"}, "HÉLLO WÖRLD"},
+		{"lower", []any{"ÉCOLE"}, "école"},
+		{"title", []any{"hello WORLD, it's ünïcode"}, "Hello World, It's Ünïcode"},
+		{"capitalize", []any{"élan VITAL"}, "Élan vital"},
+		{"capitalize", []any{""}, ""},
+		{"trim", []any{"  a b \n"}, "a b"},
+		{"trim", []any{"--a--", "-"}, "a"},
+		{"ltrim", []any{"  a  "}, "a  "},
+		{"rtrim", []any{"xxaxx", "x"}, "xxa"},
+		{"replace", []any{"a-b-c", "-", "+"}, "a+b+c"},
+		{"replace", []any{"a-b-c", "-", "", 1}, "ab-c"},
+		{"split", []any{" a  b c "}, []string{"a", "b", "c"}},
+		{"split", []any{"a,b", ","}, []string{"a", "b"}},
+		{"truncate", []any{"ünïcode text", 8}, "ünïco..."},
+		{"truncate", []any{"short", 8}, "short"},
+		{"truncate", []any{"ünïcode text", 8, "…"}, "ünïcode…"},
+		{"truncate", []any{"abcdef", 2}, "ab"},
+		{"wordwrap", []any{"the quick brown fox jumps", 10}, "the quick\nbrown fox\njumps"},
+		{"wordwrap", []any{"a verylongword b\nc d", 3, "<br>"}, "a<br>verylongword<br>b<br>c d"},
+		{"indent", []any{"a\nb\n\nc", 2}, "a\n  b\n\n  c"},
+		{"indent", []any{"a\nb", 1, true}, " a\n b"},
+		{"center", []any{"ünï", 8}, "  ünï   "},
+		{"center", []any{"long", 2}, "long"},
+		{"striptags", []any{"<p>Fish &amp; <b>chips</b></p>\n<!-- <i>x</i> -->ok"}, "Fish & chips ok"},
+		{"nl2br", []any{"a<b>\nc"}, SafeString("a&lt;b&gt;<br>\nc")},
+		{"nl2br", []any{SafeString("<i>a</i>\r\nb")}, SafeString("<i>a</i><br>\r\nb")},
+		{"slugify", []any{"Hello, Wörld! 2024"}, "hello-wörld-2024"},
+		{"format", []any{"%s has %d items", "cart", 3}, "cart has 3 items"},
+		{"upper", []any{12}, "12"},
+		{"default", []any{nil, "none"}, "none"},
+		{"default", []any{"", "none"}, ""},
+		{"default", []any{"", "none", true}, "none"},
+		{"default", []any{0, 5, true}, 5},
+		{"default", []any{"x", "none", true}, "x"},
+	})
+
+	_, err := defaultEngine.callFilter(filters["upper"], reflect.ValueOf([]int{1}))
+	assert.EqualError(t, err, "can't convert type []int to string")
+}
+
+func TestDefaultFilter(t *testing.T) {
+	cases := []struct {
+		tpl, expected string
+	}{
+		{`{{ missing|default("none") }}`, `none`},
+		{`{{ nothing|default("none") }}`, `none`},
+		{`{{ name|default("none") }}`, `Bob`},
+		{`{{ empty|default("none", true)|upper }}`, `NONE`},
+		{`{{ text|nl2br }}`, "&lt;b&gt;<br>\n"},
+		{`{{ u.nick|default("anon") }}`, `anon`},
+		{`{{ u.name|default("anon") }}`, `Ann`},
+		{`{{ u["nick"]|default("anon") }}`, `anon`},
+		{`{{ role.Title|default("none") }}`, `none`},
+	}
+	ps := Params{"name": "Bob", "nothing": nil, "empty": "", "text": "<b>\n",
+		"u": map[string]string{"name": "Ann"}, "role": &Role{name: "Admin"}}
+	for _, c := range cases {
+		sb := &strings.Builder{}
+		err := RenderView(c.tpl, sb, ps)
+		assert.Nil(t, err, c.tpl)
+		assert.Equal(t, c.expected, sb.String(), c.tpl)
+	}
+
+	err := RenderView(`{{ missing|upper }}`, &strings.Builder{}, nil)
+	assert.EqualError(t, err, "variable named missing doesn't exist in line 1, column 4")
+	err = RenderView(`{{ u.nick|upper }}`, &strings.Builder{}, ps)
+	assert.ErrorContains(t, err, "index nick doesn't exist in map")
+}
+
+func TestCollectionFilters(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+		City map[string]string
+	}
+	var (
+		ann = &user{"ann", 31, map[string]string{"name": "Paris"}}
+		bob = &user{"bob", 25, map[string]string{"name": "Oslo"}}
+		cat = &user{"cat", 25, map[string]string{"name": "Paris"}}
+		m   = map[string]int{"b": 2, "a": 1, "c": 3}
+	)
+	users := []*user{ann, bob, cat}
+	testFilters(t, []filterCase{
+		{"first", []any{[]int{3, 4}}, 3},
+		{"first", []any{"ünï"}, "ü"},
+		{"first", []any{[]int{}}, nil},
+		{"first", []any{m}, 1},
+		{"last", []any{[3]string{"a", "b", "c"}}, "c"},
+		{"join", []any{[]any{1, "a", 2.5}, ", "}, "1, a, 2.5"},
+		{"join", []any{[]string{"a", "b"}}, "ab"},
+		{"reverse", []any{[]int{1, 2, 3}}, []any{3, 2, 1}},
+		{"reverse", []any{"ünï"}, "ïnü"},
+		{"sort", []any{[]any{3, 1.5, 2}}, []any{1.5, 2, 3}},
+		{"sort", []any{users, "City.name"}, []any{bob, ann, cat}},
+		{"slice", []any{[]int{1, 2, 3, 4}, 1, 2}, []any{2, 3}},
+		{"slice", []any{[]int{1, 2, 3, 4}, -3, -1}, []any{2, 3}},
+		{"slice", []any{"ünïcode", 2}, "ïcode"},
+		{"slice", []any{[]int{1}, 5}, []any{}},
+		{"batch", []any{[]int{1, 2, 3, 4, 5}, 2}, [][]any{{1, 2}, {3, 4}, {5}}},
+		{"batch", []any{[]int{1, 2, 3}, 2, 0}, [][]any{{1, 2}, {3, 0}}},
+		{"unique", []any{[]any{1, 2, 1, "1", []int{1}, []int{1}}}, []any{1, 2, "1", []int{1}}},
+		{"unique", []any{users, "Age"}, []any{ann, bob}},
+		{"keys", []any{m}, []any{"a", "b", "c"}},
+		{"keys", []any{[]string{"x", "y"}}, []any{0, 1}},
+		{"values", []any{m}, []any{1, 2, 3}},
+		{"merge", []any{m, map[string]int{"a": 0, "d": 4}}, map[string]int{"a": 0, "b": 2, "c": 3, "d": 4}},
+		{"merge", []any{[]int{1}, []string{"a"}}, []any{1, "a"}},
+		{"groupby", []any{users, "City.name"}, sortedMap{{"Oslo", []any{bob}}, {"Paris", []any{ann, cat}}}},
+		{"groupby", []any{[]map[string]any{{"t": []int{1}}, {"t": []int{2}}, {"t": []int{1}}}, "t"},
+			sortedMap{{[]int{1}, []any{map[string]any{"t": []int{1}}, map[string]any{"t": []int{1}}}}, {[]int{2}, []any{map[string]any{"t": []int{2}}}}}},
+		{"map", []any{users, "Name"}, []any{"ann", "bob", "cat"}},
+		{"selectattr", []any{users, "Age", 25}, []any{bob, cat}},
+		{"rejectattr", []any{users, "Age", 25}, []any{ann}},
+		{"selectattr", []any{[]map[string]bool{{"on": true}, {"on": false}}, "on"}, []any{map[string]bool{"on": true}}},
+		{"sum", []any{[]int{1, 2, 3}}, int64(6)},
+		{"sum", []any{[]any{1, 2.5}}, 3.5},
+		{"sum", []any{users, "Age"}, int64(81)},
+		{"sum", []any{[]int{}}, 0},
+		{"min", []any{[]int{3, 1, 2}}, 1},
+		{"max", []any{users, "Age"}, ann},
+		{"min", []any{users, "Age"}, bob},
+		{"max", []any{[]int{}}, nil},
+		{"contains", []any{[]int{1, 2}, 2}, true},
+		{"contains", []any{[]int{1, 2}, 2.0}, true},
+		{"contains", []any{m, "z"}, false},
+		{"contains", []any{m, "a"}, true},
+		{"contains", []any{"hello", "ell"}, true},
+	})
+
+	_, err := defaultEngine.callFilter(filters["merge"], reflect.ValueOf(m), reflect.ValueOf(map[string]string{"a": "x"}))
+	assert.EqualError(t, err, "can't merge map value: value has type string; should be int")
+	_, err = defaultEngine.callFilter(filters["map"], reflect.ValueOf(users), reflect.ValueOf("Nope"))
+	assert.ErrorContains(t, err, "can't get Nope")
+	for _, v := range []any{5, make(chan int), &cursor{rows: []string{"a"}}} {
+		_, err = defaultEngine.callFilter(filters["first"], reflect.ValueOf(v))
+		assert.ErrorContains(t, err, "as list", v)
+	}
+	err = RenderView(`{{ 3|join(",") }}`, &strings.Builder{}, nil)
+	assert.ErrorContains(t, err, "can't use type int as list")
+}
+
+func TestCollectionFiltersRender(t *testing.T) {
+	ps := Params{"rows": []map[string]any{
+		{"name": "ann", "team": "b", "score": 3},
+		{"name": "bob", "team": "a", "score": 5},
+		{"name": "cat", "team": "b", "score": 4},
+	}}
+	cases := []struct {
+		tpl, expected string
+	}{
+		{`{% for team, rows in rows|groupby("team") %}{{ team }}:{{ rows|map("name")|join(",") }};{% endfor %}`, `a:bob;b:ann,cat;`},
+		{`{% for row in rows|sort("score")|reverse|slice(0, 2) %}{{ row.name }}{% endfor %}`, `bobcat`},
+		{`{{ rows|map("score")|sum }}/{{ rows|length }}`, `12/3`},
+		{`{% for b in rows|batch(2) %}[{{ b|map("name")|join }}]{% endfor %}`, `[annbob][cat]`},
+		{`{% if rows|map("team")|contains("a") %}yes{% endif %}`, `yes`},
+	}
+	for _, c := range cases {
+		sb := &strings.Builder{}
+		err := RenderView(c.tpl, sb, ps)
+		assert.Nil(t, err, c.tpl)
+		assert.Equal(t, c.expected, sb.String(), c.tpl)
+	}
+}
+
+func TestNumberFilters(t *testing.T) {
+	testFilters(t, []filterCase{
+		{"round", []any{0.1 + 0.2, 2}, 0.3},
+		{"round", []any{1.005, 2}, 1.01},
+		{"round", []any{2.5}, 3.0},
+		{"round", []any{-2.5}, -3.0},
+		{"round", []any{1.234, 1, "ceil"}, 1.3},
+		{"round", []any{1.299, 2, "floor"}, 1.29},
+		{"round", []any{1250, -2}, 1300.0},
+		{"round", []any{"3.14159", 3}, 3.142},
+		{"round", []any{uint8(7)}, 7.0},
+		{"abs", []any{-3}, 3},
+		{"abs", []any{int8(-3)}, int8(3)},
+		{"abs", []any{uint(3)}, uint(3)},
+		{"abs", []any{-1.5}, 1.5},
+		{"floor", []any{1.7}, 1.0},
+		{"floor", []any{-1.2}, -2.0},
+		{"ceil", []any{int32(4)}, 4.0},
+		{"ceil", []any{1.2}, 2.0},
+		{"number_format", []any{1234567.891}, "1,234,568"},
+		{"number_format", []any{1234567.891, 2}, "1,234,567.89"},
+		{"number_format", []any{-1234.5, 2, ",", " "}, "-1 234,50"},
+		{"number_format", []any{0.1 + 0.2, 2}, "0.30"},
+		{"number_format", []any{uint64(999)}, "999"},
+		{"percent", []any{0.256}, "26%"},
+		{"percent", []any{0.256, 1}, "25.6%"},
+		{"percent", []any{1}, "100%"},
+		{"filesizeformat", []any{1}, "1 Byte"},
+		{"filesizeformat", []any{512}, "512 Bytes"},
+		{"filesizeformat", []any{1500}, "1.5 KB"},
+		{"filesizeformat", []any{int64(3) << 30, true}, "3.0 GiB"},
+		{"filesizeformat", []any{1048576, true}, "1.0 MiB"},
+		{"ordinal", []any{1}, "1st"},
+		{"ordinal", []any{2}, "2nd"},
+		{"ordinal", []any{3}, "3rd"},
+		{"ordinal", []any{4}, "4th"},
+		{"ordinal", []any{11}, "11th"},
+		{"ordinal", []any{112}, "112th"},
+		{"ordinal", []any{121}, "121st"},
+		{"ordinal", []any{-22}, "-22nd"},
+		{"ordinal", []any{3.0}, "3rd"},
+	})
+
+	_, err := defaultEngine.callFilter(filters["round"], reflect.ValueOf(1.5), reflect.ValueOf(0), reflect.ValueOf("up"))
+	assert.EqualError(t, err, "unknown round method up; should be common, ceil or floor")
+	_, err = defaultEngine.callFilter(filters["ordinal"], reflect.ValueOf(1.5))
+	assert.EqualError(t, err, "can't use 1.5 as ordinal number")
+	_, err = defaultEngine.callFilter(filters["abs"], reflect.ValueOf("x"))
+	assert.EqualError(t, err, `can't use "x" as number`)
+
+	sb := &strings.Builder{}
+	err = RenderView(`{{ (0.1 + 0.2)|round(2) }} {{ total|number_format(2) }}`, sb, Params{"total": 1999.999})
+	assert.Nil(t, err)
+	assert.Equal(t, "0.3 2,000.00", sb.String())
+}
+
+func TestDateFilters(t *testing.T) {
+	tm := time.Date(2024, time.March, 5, 14, 7, 9, 123456000, time.UTC)
+	testFilters(t, []filterCase{
+		{"date", []any{tm}, "2024-03-05 14:07:09"},
+		{"date", []any{&tm, "Jan 2, 2006 at 3:04pm"}, "Mar 5, 2024 at 2:07pm"},
+		{"date", []any{tm, "%Y-%m-%d %H:%M:%S.%f %Z"}, "2024-03-05 14:07:09.123456 UTC"},
+		{"date", []any{tm, "%a %A %b %B %e %j %I%p %u %w %y %% %D %T"}, "Tue Tuesday Mar March  5 065 02PM 2 2 24 % 03/05/24 14:07:09"},
+		{"date", []any{0, "%F %s"}, "1970-01-01 0"},
+		{"date", []any{"2024-03-05", "02/01/2006"}, "05/03/2024"},
+		{"date", []any{"2024-03-05T10:00:00+02:00", "%H:%M %z"}, "10:00 +0200"},
+		{"date", []any{1.5, "05.000"}, "01.500"},
+	})
+
+	berlin, err := timezone(tm, "Europe/Berlin")
+	assert.Nil(t, err)
+	assert.Equal(t, "15:07 CET", berlin.Format("15:04 MST"))
+	_, err = timezone(tm, "Mars/Olympus")
+	assert.EqualError(t, err, "unknown time zone Mars/Olympus")
+	_, err = date(tm, "%Q")
+	assert.EqualError(t, err, `unknown directive %Q in "%Q"`)
+	_, err = date("yesterday")
+	assert.EqualError(t, err, `can't use "yesterday" as time`)
+
+	for _, c := range []struct {
+		d        time.Duration
+		expected string
+	}{
+		{10 * time.Second, "just now"},
+		{-90 * time.Second, "1 minute ago"},
+		{3 * time.Hour, "in 3 hours"},
+		{-49 * time.Hour, "2 days ago"},
+		{-65 * 24 * time.Hour, "2 months ago"},
+		{800 * 24 * time.Hour, "in 2 years"},
+	} {
+		s, err := timeago(tm.Add(c.d), tm)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, s)
+	}
+}
+
+func TestDateRender(t *testing.T) {
+	tm := time.Date(2024, time.March, 5, 14, 7, 9, 0, time.UTC)
+	engine := NewEngine(nil)
+	engine.SetClock(func() time.Time { return tm })
+	ps := Params{
+		"created": tm.Add(-5 * time.Minute),
+		"due":     tm.Add(48 * time.Hour),
+		"ttl":     90 * time.Second,
+		"limit":   time.Minute,
+	}
+	cases := []struct {
+		tpl, expected string
+	}{
+		{`{{ now()|date("%d.%m.%Y") }}`, `05.03.2024`},
+		{`{{ created|timeago }}, due {{ due|timeago }}`, `5 minutes ago, due in 2 days`},
+		{`{{ now()|timezone("America/New_York")|date("15:04 MST") }}`, `09:07 EST`},
+		{`{% if due > now() %}open{% endif %}{% if created < now() %}, old{% endif %}`, `open, old`},
+		{`{% if now() == created %}same{% else %}different{% endif %}`, `different`},
+		{`{% if ttl > limit %}{{ ttl }}{% endif %}`, `1m30s`},
+		{`{{ created }}`, `2024-03-05T14:02:09Z`},
+	}
+	for _, c := range cases {
+		sb := &strings.Builder{}
+		err := engine.RenderView(c.tpl, sb, ps)
+		assert.Nil(t, err, c.tpl)
+		assert.Equal(t, c.expected, sb.String(), c.tpl)
+	}
+}
+
+func TestEncodingFilters(t *testing.T) {
+	testFilters(t, []filterCase{
+		{"json_encode", []any{map[string]any{"b": []int{1, 2}, "a": "<x&y>"}}, htmlTemplate.JS(`{"a":"\u003cx\u0026y\u003e","b":[1,2]}`)},
+		{"json_encode", []any{[]any{"a", 1}, 2}, htmlTemplate.JS("[\n  \"a\",\n  1\n]")},
+		{"json_decode", []any{`{"a": [1, "b", null]}`}, map[string]any{"a": []any{1.0, "b", nil}}},
+		{"url_encode", []any{"a b/c&d"}, "a+b%2Fc%26d"},
+		{"url_encode", []any{"a b/c&d", "path"}, "a%20b/c&d"},
+		{"url_encode", []any{"/a?b/../c%d/", "path"}, "/a%3Fb/../c%25d/"},
+		{"url_encode", []any{map[string]any{"tag": []string{"a", "b c"}, "q": "go"}}, "q=go&tag=a&tag=b+c"},
+		{"base64_encode", []any{"hello?>"}, "aGVsbG8/Pg=="},
+		{"base64_encode", []any{"hello?>", true}, "aGVsbG8_Pg=="},
+		{"base64_encode", []any{[]byte{0xff}}, "/w=="},
+		{"base64_decode", []any{"aGVsbG8/Pg=="}, "hello?>"},
+		{"base64_decode", []any{"aGVsbG8_Pg"}, "hello?>"},
+		{"xml_escape", []any{`<a href="x">Tom & 'Jerry'</a>`}, SafeString("&lt;a href=&#34;x&#34;&gt;Tom &amp; &#39;Jerry&#39;&lt;/a&gt;")},
+		{"csv_escape", []any{"plain"}, "plain"},
+		{"csv_escape", []any{`say "hi", bye`}, `"say ""hi"", bye"`},
+		{"csv_escape", []any{[]any{"a", 1, "b;c", "d\ne"}, ";"}, "a;1;\"b;c\";\"d\ne\""},
+		{"md5", []any{"abc"}, "900150983cd24fb0d6963f7d28e17f72"},
+		{"sha1", []any{"abc"}, "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{"sha256", []any{"abc"}, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	})
+
+	_, err := urlEncode(newCompareMap(), "x", "fragment")
+	assert.EqualError(t, err, "unknown url flavor fragment; should be query or path")
+	_, err = base64Decode("%%%")
+	assert.EqualError(t, err, `can't decode "%%%" as base64`)
+	_, err = jsonDecode("{")
+	assert.EqualError(t, err, "can't decode json: unexpected end of JSON input")
+	_, err = csvEscape(newCompareMap(), "x", "ab")
+	assert.EqualError(t, err, `can't use "ab" as csv separator`)
+}
+
+func TestEncodingRender(t *testing.T) {
+	ps := Params{
+		"event": map[string]any{"id": 7, "name": "a&b"},
+		"path":  "docs/a b.pdf",
+		"body":  `{"user": {"name": "Ann"}}`,
+	}
+	cases := []struct {
+		tpl, expected string
+	}{
+		{`{{ event|json_encode }}`, `{"id":7,"name":"a\u0026b"}`},
+		{`/files/{{ path|url_encode("path") }}?sig={{ path|sha256|slice(0, 8) }}`, `/files/docs/a%20b.pdf?sig=a75d6f6b`},
+		{`<name>{{ event.name|xml_escape }}</name>`, `<name>a&amp;b</name>`},
+		{`{% set data = body|json_decode %}{{ data.user.name }}`, `Ann`},
+		{`{{ "hi"|base64_encode|base64_decode }}`, `hi`},
+	}
+	for _, c := range cases {
+		sb := &strings.Builder{}
+		err := NewEngine(nil).RenderView(c.tpl, sb, ps)
+		assert.Nil(t, err, c.tpl)
+		assert.Equal(t, c.expected, sb.String(), c.tpl)
+	}
+
+	engine := NewEngine(nil)
+	engine.SetLoader(MapLoader{"hook.html": `<script>var event = {{ event|json_encode }};</script><p>{{ event|json_encode }}</p>`})
+	sb := &strings.Builder{}
+	err := engine.Render("hook.html", sb, Params{"event": map[string]any{"body": "</script><b>"}})
+	assert.Nil(t, err)
+	assert.Equal(t, `<script>var event = {"body":"\u003c/script\u003e\u003cb\u003e"};</script><p>{&#34;body&#34;:&#34;\u003c/script\u003e\u003cb\u003e&#34;}</p>`, sb.String())
+}
@@ -14,6 +14,11 @@ var (
 	errorType = reflect.TypeOf((*error)(nil)).Elem()
 )
 
+// A missingError reports a map key or an attribute which doesn't exist.
+type missingError struct {
+	error
+}
+
 func get(p any, keys ...any) (value reflect.Value, err error) {
 	value = reflect.ValueOf(p)
 	for _, key := range keys {
@@ -29,6 +34,7 @@ func get(p any, keys ...any) (value reflect.Value, err error) {
 				var (
 					tmpValue reflect.Value
 					tmpErr   error
+					callErr  error // error returned by a method without arguments
 				)
 				tmpValue, err = property(value, name)
 				if err != nil {
@@ -38,15 +44,22 @@ func get(p any, keys ...any) (value reflect.Value, err error) {
 						if fn, tmpErr = method(value, fnName); tmpErr == nil {
 							if tmpValue, tmpErr = call(fn); tmpErr == nil {
 								break
+							} else if fn.Type().NumIn() == 0 && callErr == nil {
+								callErr = tmpErr
 							}
+							tmpValue = zeroValue
 						}
 					}
+					if zeroValue == tmpValue && callErr != nil {
+						err = callErr
+						return
+					}
 					if zeroValue == tmpValue {
-						err = errors.Errorf("neither property %s, nor methods %v exist in type %s",
+						err = missingError{errors.Errorf("neither property %s, nor methods %v exist in type %s",
 							name,
 							strings.Join(fnNames, "/"),
 							value.Type(),
-						)
+						)}
 						return
 					}
 				}
@@ -93,18 +106,12 @@ func index(value reflect.Value, index reflect.Value) (reflect.Value, error) {
 		if err != nil {
 			return zeroValue, errors.Errorf("con't use type %s as map[%s] key", index.Type(), kType.Name())
 		}
-		keyExist := false
-		keys := value.MapKeys()
-		for _, v := range keys {
-			if v.Interface() == x.Interface() {
-				keyExist = true
-			}
-		}
-		if !keyExist {
-			return zeroValue, errors.Errorf("index %s doesn't exist in map keys %s", x, keys)
+		item := value.MapIndex(x)
+		if !item.IsValid() {
+			return zeroValue, missingError{errors.Errorf("index %s doesn't exist in map keys %s", x, value.MapKeys())}
 		}
 
-		return value.MapIndex(x), nil
+		return item, nil
 
 	default:
 		return zeroValue, errors.Errorf("can't index item of type %s", value.Type())
@@ -164,6 +171,9 @@ func divide(x, y reflect.Value) (reflect.Value, error) {
 func eq(x, y reflect.Value) (reflect.Value, error) {
 	x = uncoverInterface(x)
 	y = uncoverInterface(y)
+	if tx, ty, ok := times(x, y); ok {
+		return reflect.ValueOf(tx.Equal(ty)), nil
+	}
 	if !x.Type().Comparable() || !y.Type().Comparable() {
 		return reflect.ValueOf(false), errors.Errorf("con't compare type %s and %b", x.Type(), y.Type())
 	}
@@ -223,7 +233,7 @@ func calc(x, y reflect.Value, op string) (reflect.Value, error) {
 	y = uncoverInterface(y)
 
 	if isNumber(x.Kind()) && isNumber(y.Kind()) {
-		if y.IsZero() {
+		if op == "/" && y.IsZero() {
 			return zeroValue, errors.New("can't use 0 as denominator")
 		}
 		var z, a, b any
@@ -305,6 +315,9 @@ func calc(x, y reflect.Value, op string) (reflect.Value, error) {
 func greater(x, y reflect.Value) (reflect.Value, error) {
 	x = uncoverInterface(x)
 	y = uncoverInterface(y)
+	if tx, ty, ok := times(x, y); ok {
+		return reflect.ValueOf(tx.After(ty)), nil
+	}
 	if x.Type().Kind() != y.Type().Kind() {
 		if isNumber(x.Kind()) && isNumber(y.Kind()) {
 			if z, err := sub(x, y); err == nil {
@@ -362,6 +375,12 @@ func method(value reflect.Value, name string) (reflect.Value, error) {
 	}
 
 	method, exist := value.Type().MethodByName(name)
+	if !exist {
+		// methods are called by their name in lower camel case too, such as
+		// loop.cycle()
+		name = ucFirst(name)
+		method, exist = value.Type().MethodByName(name)
+	}
 	if !exist {
 		return zeroValue, errors.Errorf("method named %s doesn't exist in type %s", name, value.Type())
 	}
@@ -433,6 +452,9 @@ func invoke(fn reflect.Value, argv []reflect.Value) (reflect.Value, error) {
 func prepareValueType(value reflect.Value, typ reflect.Type) (reflect.Value, error) {
 	value = uncoverInterface(value)
 	if !value.IsValid() {
+		if typ.Kind() == reflect.Interface {
+			return reflect.Zero(typ), nil
+		}
 		return zeroValue, errors.Errorf("nil value, should be type %s", typ)
 	}
 
@@ -7,12 +7,12 @@ import (
 	"github.com/pkg/errors"
 )
 
-var (
-	func_map = &funcMap{
+func newFuncMap() *funcMap {
+	return &funcMap{
 		store:  buildInFuncs(),
 		locker: &sync.RWMutex{},
 	}
-)
+}
 
 type funcMap struct {
 	store  map[string]reflect.Value
@@ -20,6 +20,10 @@ type funcMap struct {
 }
 
 func RegisterFunc(name string, fn any) error {
+	return defaultEngine.RegisterFunc(name, fn)
+}
+
+func (fm *funcMap) register(name string, fn any) error {
 	if fn == nil {
 		return nil
 	}
@@ -33,18 +37,18 @@ func RegisterFunc(name string, fn any) error {
 	if !goodFunc(fnValue.Type()) {
 		return errors.Errorf("func return %d values; should be 1 or 2", fnValue.Type().NumOut())
 	}
-	func_map.locker.Lock()
-	defer func_map.locker.Unlock()
-	func_map.store[name] = fnValue
+	fm.locker.Lock()
+	defer fm.locker.Unlock()
+	fm.store[name] = fnValue
 
 	return nil
 }
 
-func getFunc(name string) reflect.Value {
-	func_map.locker.RLock()
-	defer func_map.locker.RUnlock()
+func (fm *funcMap) get(name string) reflect.Value {
+	fm.locker.RLock()
+	defer fm.locker.RUnlock()
 
-	if fn, ok := func_map.store[name]; ok {
+	if fn, ok := fm.store[name]; ok {
 		return fn
 	}
 
@@ -2,6 +2,7 @@ package template
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/pkg/errors"
@@ -142,6 +143,9 @@ func TestCalc(t *testing.T) {
 	testCalc(t, 1, 2, "/", float64(0.5))
 	_, err := calc(reflect.ValueOf(1), reflect.ValueOf(0), "/")
 	assert.ErrorContains(t, err, "can't use 0 as denominator")
+	testCalc(t, 1, 0, "+", int64(1))
+	testCalc(t, 1.5, 0, "-", 1.5)
+	testCalc(t, 2, 0, "*", int64(0))
 
 	testCalc(t, uint(1), 2, "+", int64(3))
 	testCalc(t, uint(1), 2, "-", int64(-1))
@@ -280,3 +284,46 @@ func TestGet(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, val.Interface(), "Bar")
 }
+
+type point struct{ x, y int }
+
+func TestOrder(t *testing.T) {
+	cm := newCompareMap()
+	assert.Equal(t, -1, cm.order(2, 10))
+	assert.Equal(t, 1, cm.order(uint8(3), 2.5))
+	assert.Equal(t, -1, cm.order("10", "9"))
+	assert.Equal(t, 0, cm.order(false, false))
+	assert.Equal(t, -1, cm.order(nil, 1))
+
+	err := cm.register(func(a, b point) int {
+		return compareInt(a.x*a.x+a.y*a.y, b.x*b.x+b.y*b.y)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cm.order(point{3, 0}, point{1, 1}))
+	assert.Equal(t, -1, newCompareMap().order(point{3, 0}, point{4, 0}))
+	assert.EqualError(t, cm.register(func(a point, b int) int { return 0 }),
+		"can't register func(template.point, int) int as compare func; should be func(x, y T) int")
+	assert.EqualError(t, cm.register(1), "can't register int as compare func")
+
+	sorted, err := sortby(cm, map[string]int{"a": 3, "b": 1, "c": 2}, "value")
+	assert.Nil(t, err)
+	assert.Equal(t, sortedMap{{"b", 1}, {"c", 2}, {"a", 3}}, sorted)
+	_, err = sortby(cm, map[string]int{}, "size")
+	assert.EqualError(t, err, "can't sort by size; should be key or value")
+	_, err = sortby(cm, []int{1}, "value")
+	assert.EqualError(t, err, "can't sort []int by key or value")
+}
+
+func TestEngineCompare(t *testing.T) {
+	byX, byY := NewEngine(nil), NewEngine(nil)
+	assert.Nil(t, byX.RegisterCompare(func(a, b point) int { return compareInt(a.x, b.x) }))
+	assert.Nil(t, byY.RegisterCompare(func(a, b point) int { return compareInt(a.y, b.y) }))
+	ps := Params{"m": map[point]string{{1, 2}: "a", {2, 1}: "b"}}
+	tpl := `{% for k, v in m %}{{ v }}{% endfor %}|{{ m|values|join }}`
+	for engine, expected := range map[*Engine]string{byX: "ab|ab", byY: "ba|ba"} {
+		sb := &strings.Builder{}
+		err := engine.RenderView(tpl, sb, ps)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, sb.String())
+	}
+}
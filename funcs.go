@@ -8,7 +8,12 @@ var funcs = map[string]reflect.Value{
 }
 
 func buildInFuncs() map[string]reflect.Value {
-	return funcs
+	store := make(map[string]reflect.Value, len(funcs))
+	for name, fn := range funcs {
+		store[name] = fn
+	}
+
+	return store
 }
 
 func PS(ps ...Params) Params {
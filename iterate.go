@@ -0,0 +1,214 @@
+package template
+
+import (
+	"context"
+	"iter"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// Iterator is ranged over by for loops item by item, such as a database
+// cursor, without collecting its items first.
+type Iterator interface {
+	// Next advances to the next item, it returns false when none is left.
+	Next() bool
+	// Value returns the current item.
+	Value() any
+}
+
+// forItem is an item of the value ranged over by a for loop.
+type forItem struct {
+	key, value any
+}
+
+// nextFunc returns the next item of a for loop, ok is false when none is
+// left.
+type nextFunc func() (item forItem, ok bool, err error)
+
+// iterate returns the func pulling the items of v one by one, and their
+// number, -1 if it isn't known in advance. stop must be called once the loop
+// ends. The entries of maps are sorted by key, and channels stop being read
+// when ctx is done. Items keyed by their position have no key unless keyed
+// is true, which spares boxing the positions.
+func iterate(ctx context.Context, cm *compareMap, v reflect.Value, keyed bool) (next nextFunc, length int, stop func(), err error) {
+	stop = func() {}
+	if !v.IsValid() || (v.Kind() == reflect.Pointer && v.IsNil()) {
+		return nil, 0, stop, errors.New("can't iter nil")
+	}
+	if v.CanInterface() {
+		switch x := v.Interface().(type) {
+		case sortedMap:
+			return items(x), len(x), stop, nil
+		case Iterator:
+			return iterator(x, keyed), -1, stop, nil
+		}
+	}
+	switch {
+	case v.Kind() == reflect.Map:
+		list := entries(cm, v)
+
+		return items(list), len(list), stop, nil
+
+	case v.Kind() == reflect.Slice, v.Kind() == reflect.Array, v.Kind() == reflect.String:
+		i := 0
+		return func() (forItem, bool, error) {
+			if i >= v.Len() {
+				return forItem{}, false, nil
+			}
+			item := forItem{value: v.Index(i).Interface()}
+			if keyed {
+				item.key = i
+			}
+			i++
+
+			return item, true, nil
+		}, v.Len(), stop, nil
+
+	case isIntLike(v.Kind()), isUintLike(v.Kind()):
+		n := 0
+		if isIntLike(v.Kind()) && v.Int() > 0 {
+			n = int(v.Int())
+		} else if isUintLike(v.Kind()) {
+			n = int(v.Uint())
+		}
+		i := 0
+		return func() (forItem, bool, error) {
+			if i >= n {
+				return forItem{}, false, nil
+			}
+			item := forItem{value: i}
+			if keyed {
+				item.key = i
+			}
+			i++
+
+			return item, true, nil
+		}, n, stop, nil
+
+	case v.Kind() == reflect.Chan:
+		if v.Type().ChanDir()&reflect.RecvDir == 0 {
+			return nil, 0, stop, errors.Errorf("can't iter send-only channel %s", v.Type())
+		}
+
+		return channel(ctx, v, keyed), -1, stop, nil
+
+	case v.Kind() == reflect.Func:
+		if seq, ok := seqOf(v); ok {
+			pull, stop := iter.Pull2(seq)
+			return func() (forItem, bool, error) {
+				k, x, ok := pull()
+				return forItem{k, x}, ok, nil
+			}, -1, stop, nil
+		}
+	}
+
+	return nil, 0, stop, errors.Errorf("can't iter type %s", v.Type())
+}
+
+// items returns the func pulling the items of list.
+func items(list []forItem) nextFunc {
+	i := 0
+	return func() (forItem, bool, error) {
+		if i >= len(list) {
+			return forItem{}, false, nil
+		}
+		i++
+
+		return list[i-1], true, nil
+	}
+}
+
+// entries returns the entries of the map m sorted by key.
+func entries(cm *compareMap, m reflect.Value) []forItem {
+	list := make([]forItem, 0, m.Len())
+	iter := m.MapRange()
+	for iter.Next() {
+		list = append(list, forItem{iter.Key().Interface(), iter.Value().Interface()})
+	}
+	cm.sortItems(list)
+
+	return list
+}
+
+// collect pulls all the items left.
+func collect(next nextFunc) ([]forItem, error) {
+	var list []forItem
+	for {
+		item, ok, err := next()
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return list, nil
+		}
+		list = append(list, item)
+	}
+}
+
+func iterator(it Iterator, keyed bool) nextFunc {
+	i := 0
+	return func() (forItem, bool, error) {
+		if !it.Next() {
+			return forItem{}, false, nil
+		}
+		item := forItem{value: it.Value()}
+		if keyed {
+			item.key = i
+		}
+		i++
+
+		return item, true, nil
+	}
+}
+
+// channel returns the func receiving the items of ch until it's closed or ctx
+// is done.
+func channel(ctx context.Context, ch reflect.Value, keyed bool) nextFunc {
+	cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: ch}}
+	if ctx != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+	}
+	i := 0
+	return func() (forItem, bool, error) {
+		chosen, x, ok := reflect.Select(cases)
+		if chosen != 0 || !ok {
+			return forItem{}, false, nil
+		}
+		item := forItem{value: x.Interface()}
+		if keyed {
+			item.key = i
+		}
+		i++
+
+		return item, true, nil
+	}
+}
+
+// seqOf converts v to an iter.Seq2, if it's a func in the shape of iter.Seq
+// or iter.Seq2 of any types. The items of an iter.Seq are keyed by position.
+func seqOf(v reflect.Value) (iter.Seq2[any, any], bool) {
+	typ := v.Type()
+	if v.IsNil() || typ.NumIn() != 1 || typ.NumOut() != 0 {
+		return nil, false
+	}
+	yield := typ.In(0)
+	if yield.Kind() != reflect.Func || yield.IsVariadic() || yield.NumIn() < 1 || yield.NumIn() > 2 ||
+		yield.NumOut() != 1 || yield.Out(0).Kind() != reflect.Bool {
+		return nil, false
+	}
+
+	return func(fn func(any, any) bool) {
+		i := 0
+		v.Call([]reflect.Value{reflect.MakeFunc(yield, func(args []reflect.Value) []reflect.Value {
+			var more bool
+			if len(args) == 2 {
+				more = fn(args[0].Interface(), args[1].Interface())
+			} else {
+				more = fn(i, args[0].Interface())
+				i++
+			}
+
+			return []reflect.Value{reflect.ValueOf(more).Convert(yield.Out(0))}
+		})})
+	}, true
+}
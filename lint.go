@@ -0,0 +1,95 @@
+package template
+
+// Lint validates the template of name like Validate does, and also reports
+// the blocks of a child template which don't exist in its parents and the
+// variables set but never used.
+func (e *Engine) Lint(name string) error {
+	var errs ErrorList
+	switch err := e.Validate(name).(type) {
+	case nil:
+	case Error, ErrorList:
+		errs.add(err)
+	default:
+		return err
+	}
+	doc := e.cache.doc(cleanName(name))
+	if doc == nil {
+		return errs.err()
+	}
+	errs.add(lintBlocks(doc))
+	errs.add(e.lintVars(doc))
+
+	return errs.err()
+}
+
+// lintBlocks reports the top level blocks of doc which aren't defined by any
+// of the templates it extends.
+func lintBlocks(doc *Document) error {
+	if doc.extend == nil || doc.body == nil {
+		return nil
+	}
+	var errs ErrorList
+	for _, x := range doc.body.list {
+		block, ok := x.(*blockDirect)
+		if !ok {
+			continue
+		}
+		defined := false
+		for d := doc.extend.doc; d != nil && !defined; {
+			_, defined = d.blocks[block.name.value.value]
+			if d.extend == nil {
+				break
+			}
+			d = d.extend.doc
+		}
+		if !defined {
+			errs.add(newUndefinedError(CodeUndefinedBlock, block.name.value, block.name.value.value))
+		}
+	}
+
+	return errs.err()
+}
+
+// lintVars reports the variables set by doc which are read neither by doc
+// nor by the templates it extends or includes.
+func (e *Engine) lintVars(doc *Document) error {
+	var (
+		errs ErrorList
+		sets []*token
+		read = make(map[string]bool)
+	)
+	walk(doc.body, func(n node) {
+		if d, ok := n.(*assignDirect); ok {
+			sets = append(sets, d.lh.name)
+		}
+	})
+	if len(sets) == 0 {
+		return nil
+	}
+	e.reads(doc, read, make(map[*Document]bool))
+	for _, tok := range sets {
+		if !read[tok.value] {
+			errs.add(&LintError{Location: tok.location(), Code: CodeUnusedVar, Msg: "variable " + tok.value + " is set but never used"})
+		}
+	}
+
+	return errs.err()
+}
+
+// reads collects the names of the variables read by doc and its deps.
+func (e *Engine) reads(doc *Document, read map[string]bool, checked map[*Document]bool) {
+	if checked[doc] {
+		return
+	}
+	checked[doc] = true
+	walk(doc.body, func(n node) {
+		if x, ok := n.(*ident); ok {
+			read[x.name.value] = true
+		}
+	})
+	for _, name := range doc.deps {
+		if dep := e.cache.doc(name); dep != nil {
+			e.reads(dep, read, checked)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package template
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Loader loads the source code of templates by name. Names are slash
+// separated and relative to the root of the loader, e.g. "layout/base.tpl".
+type Loader interface {
+	Load(name string) (string, error)
+}
+
+// Lister is implemented by loaders which are able to enumerate the templates
+// they serve, which is required by WarmUp.
+type Lister interface {
+	List() ([]string, error)
+}
+
+// NewFSLoader returns a loader reading templates from fsys, such as an
+// embed.FS or the result of os.DirFS.
+func NewFSLoader(fsys fs.FS) Loader {
+	return &fsLoader{fsys: fsys}
+}
+
+// NewDirLoader returns a loader reading templates from the directory dir.
+func NewDirLoader(dir string) Loader {
+	return NewFSLoader(os.DirFS(dir))
+}
+
+type fsLoader struct {
+	fsys fs.FS
+}
+
+func (l *fsLoader) Load(name string) (string, error) {
+	bs, err := fs.ReadFile(l.fsys, name)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bs), nil
+}
+
+func (l *fsLoader) List() (names []string, err error) {
+	err = fs.WalkDir(l.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			names = append(names, name)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// MapLoader serves templates from memory, keyed by name. Keys are cleaned
+// the way template paths are, so "./x.tpl" is served as "x.tpl".
+type MapLoader map[string]string
+
+func (l MapLoader) Load(name string) (string, error) {
+	if code, ok := l[name]; ok {
+		return code, nil
+	}
+	name = cleanName(name)
+	for key, code := range l {
+		if cleanName(key) == name {
+			return code, nil
+		}
+	}
+
+	return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (l MapLoader) List() ([]string, error) {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, cleanName(name))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// ChainLoader tries each loader in order and returns the first template
+// found. Errors other than fs.ErrNotExist stop the search.
+type ChainLoader []Loader
+
+func (l ChainLoader) Load(name string) (string, error) {
+	for _, loader := range l {
+		code, err := loader.Load(name)
+		if err == nil {
+			return code, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (l ChainLoader) List() ([]string, error) {
+	var (
+		names []string
+		seen  = make(map[string]bool)
+	)
+	for _, loader := range l {
+		lister, ok := loader.(Lister)
+		if !ok {
+			return nil, errors.Errorf("loader %T can't list templates", loader)
+		}
+		list, err := lister.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range list {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// cleanName turns a template path into the name given to loaders.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
@@ -0,0 +1,103 @@
+package template
+
+import "github.com/pkg/errors"
+
+// errUnknownLength is returned by the fields of a loop which need the number
+// of items, when it isn't known in advance.
+var errUnknownLength = errors.New("the number of items isn't known when ranging over a channel, an Iterator or an iter.Seq")
+
+// Loop is bound to the name loop in the body of a for loop, it tells the
+// position of the current item. Length, Revindex, Revindex0 and Last need
+// the number of items, they return an error when ranging over a channel, an
+// Iterator or an iter.Seq, whose items are only known one at a time.
+type Loop struct {
+	index0 int
+	length int // -1 if the items are streamed
+	parent *Loop
+}
+
+func newLoop(length int, parent *Loop) *Loop {
+	return &Loop{length: length, parent: parent}
+}
+
+// refersLoop reports whether loop may be referred to in body, by name or in
+// the templates and blocks rendered in it.
+func refersLoop(body *sectionDirect) bool {
+	refers := false
+	walk(body, func(n node) {
+		switch n := n.(type) {
+		case *ident:
+			refers = refers || n.name.value == loop_name
+		case *includeDirect, *blockDirect:
+			refers = true
+		}
+	})
+
+	return refers
+}
+
+// Index returns the position of the current item, starting at 1.
+func (l *Loop) Index() int {
+	return l.index0 + 1
+}
+
+// Index0 returns the position of the current item, starting at 0.
+func (l *Loop) Index0() int {
+	return l.index0
+}
+
+// Revindex returns the number of items left including the current one.
+func (l *Loop) Revindex() (int, error) {
+	if l.length < 0 {
+		return 0, errUnknownLength
+	}
+
+	return l.length - l.index0, nil
+}
+
+// Revindex0 returns the number of items left after the current one.
+func (l *Loop) Revindex0() (int, error) {
+	if l.length < 0 {
+		return 0, errUnknownLength
+	}
+
+	return l.length - l.index0 - 1, nil
+}
+
+// First reports whether the current item is the first one.
+func (l *Loop) First() bool {
+	return l.index0 == 0
+}
+
+// Last reports whether the current item is the last one.
+func (l *Loop) Last() (bool, error) {
+	if l.length < 0 {
+		return false, errUnknownLength
+	}
+
+	return l.index0 == l.length-1, nil
+}
+
+// Length returns the number of items.
+func (l *Loop) Length() (int, error) {
+	if l.length < 0 {
+		return 0, errUnknownLength
+	}
+
+	return l.length, nil
+}
+
+// Parent returns the loop the current one is nested in; or nil.
+func (l *Loop) Parent() *Loop {
+	return l.parent
+}
+
+// Cycle returns the values in turn, one per item, such as
+// loop.cycle("odd", "even").
+func (l *Loop) Cycle(values ...any) any {
+	if len(values) == 0 {
+		return nil
+	}
+
+	return values[l.index0%len(values)]
+}
@@ -2,6 +2,7 @@ package template
 
 import (
 	"fmt"
+	"io"
 	"reflect"
 	"strings"
 )
@@ -15,6 +16,7 @@ type expr interface {
 	node
 	exprNode()
 	literal() string
+	pos() *token // first token of the expression; or nil
 	execute(p Params) (reflect.Value, error)
 }
 
@@ -22,7 +24,7 @@ type expr interface {
 type direct interface {
 	node
 	directNode()
-	execute(p Params) (string, error)
+	execute(w io.Writer, p Params) error
 	typ() string
 }
 
@@ -92,6 +94,21 @@ func (*binaryExpr) exprNode()   {}
 func (*singleExpr) exprNode()   {}
 func (*pipelineExpr) exprNode() {}
 
+func (e *ident) pos() *token    { return e.name }
+func (e *basicLit) pos() *token { return e.value }
+func (e *listExpr) pos() *token {
+	if len(e.list) == 0 {
+		return nil
+	}
+
+	return e.list[0].pos()
+}
+func (e *indexExpr) pos() *token    { return e.x.pos() }
+func (e *callExpr) pos() *token     { return e.fn.name }
+func (e *binaryExpr) pos() *token   { return e.x.pos() }
+func (e *singleExpr) pos() *token   { return e.op }
+func (e *pipelineExpr) pos() *token { return e.x.pos() }
+
 func (e *ident) literal() string {
 	return e.name.value
 }
@@ -155,7 +172,9 @@ type (
 	}
 
 	valueDirect struct {
-		tok expr // value expr
+		tok      expr    // value expr
+		esc      escaper // escaper of the value; escape_none if not escaped
+		declared bool    // whether esc is declared by an autoescape section
 	}
 
 	ifDirect struct {
@@ -165,9 +184,25 @@ type (
 	}
 
 	forDirect struct {
-		key, value *ident // Key may be nil, Value, ident expr
-		x          expr   // value to range over
-		body       *sectionDirect
+		key, value *ident         // Key may be nil, Value, ident expr
+		x          expr           // value to range over
+		cond       expr           // filter of the items; or nil
+		body       *sectionDirect // not nil
+		el         *sectionDirect // rendered when nothing is iterated; or nil
+		loop       bool           // whether loop is bound in the body
+	}
+
+	// A breakDirect node represents {% break %} or {% break if cond %}.
+	breakDirect struct {
+		tok  *token // break keyword; not nil
+		cond expr   // condition; or nil
+	}
+
+	// A continueDirect node represents {% continue %} or
+	// {% continue if cond %}.
+	continueDirect struct {
+		tok  *token // continue keyword; not nil
+		cond expr   // condition; or nil
 	}
 
 	blockDirect struct {
@@ -186,22 +221,61 @@ type (
 		path *basicLit // string of template path
 		doc  *Document
 	}
+
+	// A macroDirect node represents a macro definition, such as
+	// {% macro field(name, type="text") %}...{% endmacro %}.
+	macroDirect struct {
+		name     *token         // name of macro; not nil
+		params   []*ident       // parameters of macro
+		defaults []expr         // default value of each parameter; nil if required
+		body     *sectionDirect // body of macro; or nil
+		doc      *Document      // document the macro is defined in; not nil
+	}
+
+	// An importDirect node represents {% import "path" as alias %}.
+	importDirect struct {
+		path  *basicLit // string of template path
+		alias *ident    // name the macros are imported as; not nil
+		doc   *Document // not nil
+	}
+
+	// A fromDirect node represents {% from "path" import name as alias %}.
+	fromDirect struct {
+		path    *basicLit // string of template path
+		names   []*ident  // names of imported macros
+		aliases []*ident  // name each macro is imported as
+		doc     *Document // not nil
+	}
+
+	// An autoescapeDirect node represents a section escaped with the given
+	// strategy, such as {% autoescape "js" %}...{% endautoescape %}.
+	autoescapeDirect struct {
+		strategy *token         // strategy token; not nil
+		esc      escaper        // escaper of the strategy
+		body     *sectionDirect // not nil
+	}
 )
 
 // directNode() ensures that only statement nodes can be
 // assigned to a Direct.
 //
 
-func (*textDirect) directNode()    {}
-func (*valueDirect) directNode()   {}
-func (*assignDirect) directNode()  {}
-func (*sectionDirect) directNode() {}
-func (*ifDirect) directNode()      {}
-func (*forDirect) directNode()     {}
-func (*blockDirect) directNode()   {}
-func (*includeDirect) directNode() {}
-func (*extendDirect) directNode()  {}
-func (*Document) directNode()      {}
+func (*textDirect) directNode()       {}
+func (*valueDirect) directNode()      {}
+func (*assignDirect) directNode()     {}
+func (*sectionDirect) directNode()    {}
+func (*ifDirect) directNode()         {}
+func (*forDirect) directNode()        {}
+func (*breakDirect) directNode()      {}
+func (*continueDirect) directNode()   {}
+func (*blockDirect) directNode()      {}
+func (*includeDirect) directNode()    {}
+func (*extendDirect) directNode()     {}
+func (*autoescapeDirect) directNode() {}
+func (*macroDirect) directNode()      {}
+func (*importDirect) directNode()     {}
+func (*fromDirect) directNode()       {}
+func (*Document) directNode()         {}
 
 func (*textDirect) typ() string {
 	return "textDirect"
@@ -221,6 +295,12 @@ func (*ifDirect) typ() string {
 func (*forDirect) typ() string {
 	return "forDirect"
 }
+func (*breakDirect) typ() string {
+	return "breakDirect"
+}
+func (*continueDirect) typ() string {
+	return "continueDirect"
+}
 func (*blockDirect) typ() string {
 	return "blockDirect"
 }
@@ -230,6 +310,18 @@ func (*includeDirect) typ() string {
 func (*extendDirect) typ() string {
 	return "extendDirect"
 }
+func (*autoescapeDirect) typ() string {
+	return "autoescapeDirect"
+}
+func (*macroDirect) typ() string {
+	return "macroDirect"
+}
+func (*importDirect) typ() string {
+	return "importDirect"
+}
+func (*fromDirect) typ() string {
+	return "fromDirect"
+}
 func (*Document) typ() string {
 	return "Document"
 }
@@ -250,6 +342,10 @@ func (s *ifDirect) append(x direct) {
 }
 
 func (s *forDirect) append(x direct) {
+	if s.el != nil {
+		s.el.list = append(s.el.list, x)
+		return
+	}
 	if s.body == nil {
 		s.body = &sectionDirect{}
 	}
@@ -262,3 +358,17 @@ func (s *blockDirect) append(x direct) {
 	}
 	s.body.list = append(s.body.list, x)
 }
+
+func (s *autoescapeDirect) append(x direct) {
+	if s.body == nil {
+		s.body = &sectionDirect{}
+	}
+	s.body.list = append(s.body.list, x)
+}
+
+func (s *macroDirect) append(x direct) {
+	if s.body == nil {
+		s.body = &sectionDirect{}
+	}
+	s.body.list = append(s.body.list, x)
+}
@@ -1,8 +1,15 @@
 package template
 
+import "context"
+
 var (
 	block_store_name   = "_blocks_"
 	block_remains_name = "__parent__"
+	engine_store_name  = "_engine_"
+	context_store_name = "_context_"
+	escaper_store_name = "_escaper_"
+	macro_store_name   = "_macros_"
+	loop_name          = "loop"
 )
 
 type Params map[string]any
@@ -32,8 +39,99 @@ func (p Params) setBlock(name string, block *blockDirect) {
 	p[block_store_name] = blocks
 }
 
+// macro returns the macro named name in the scope of p; or nil.
+func (p Params) macro(name string) *macroDirect {
+	if macros, ok := p[macro_store_name].(macroNamespace); ok {
+		return macros[name]
+	}
+
+	return nil
+}
+
+// setMacros adds macros to the scope of p, apart from its variables. The
+// macros in scope are copied first, they're shared with the params p is
+// copied from.
+func (p Params) setMacros(macros macroNamespace) {
+	if len(macros) == 0 {
+		return
+	}
+	scope, _ := p[macro_store_name].(macroNamespace)
+	merged := make(macroNamespace, len(scope)+len(macros))
+	for name, m := range scope {
+		merged[name] = m
+	}
+	for name, m := range macros {
+		merged[name] = m
+	}
+	p[macro_store_name] = merged
+}
+
 func (p Params) setBlockRemains(remains string) {
-	p[block_remains_name] = remains
+	p[block_remains_name] = SafeString(remains)
+}
+
+func (p Params) engine() *Engine {
+	if e, ok := p[engine_store_name]; ok {
+		return e.(*Engine)
+	}
+
+	return defaultEngine
+}
+
+func (p Params) setEngine(e *Engine) {
+	if e == nil {
+		return
+	}
+	p[engine_store_name] = e
+}
+
+func (p Params) context() context.Context {
+	if ctx, ok := p[context_store_name]; ok {
+		return ctx.(context.Context)
+	}
+
+	return nil
+}
+
+func (p Params) setContext(ctx context.Context) {
+	if ctx == nil {
+		return
+	}
+	p[context_store_name] = ctx
+}
+
+// escaper returns the escaper of the autoescape section being rendered, which
+// is carried into included templates.
+func (p Params) escaper() (escaper, bool) {
+	if esc, ok := p[escaper_store_name]; ok {
+		return esc.(escaper), true
+	}
+
+	return escape_none, false
+}
+
+// inherit copies the render state of p, but not its variables, into np.
+func (p Params) inherit(np Params) {
+	np.setContext(p.context())
+	if esc, ok := p.escaper(); ok {
+		np[escaper_store_name] = esc
+	}
+}
+
+// interrupted returns a *RenderError if the render context is done, tok,
+// kind and name tell the position the render stopped at, such as the func
+// named name.
+func (p Params) interrupted(tok *token, kind, name string) error {
+	ctx := p.context()
+	if ctx == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return &RenderError{Location: tok.location(), kind: kind, name: name, Err: ctx.Err()}
+	default:
+		return nil
+	}
 }
 
 func cop(p Params) Params {
@@ -1,81 +1,34 @@
 package template
 
 import (
-	"errors"
+	"context"
 	"io"
-	"io/fs"
-	"path"
-	"path/filepath"
-	"strings"
 )
 
-var (
-	config *Config
-)
-
-func Render(path string, writer io.Writer, ps Params) (err error) {
-	path = resolvePath(path)
-	doc, err := buildFileTemplate(path)
-	if err != nil {
-		return
-	}
-	body, err := doc.execute(ps)
-	if err != nil {
-		return
-	}
-
-	_, err = writer.Write([]byte(body))
-
-	return
+func Render(path string, writer io.Writer, ps Params) error {
+	return defaultEngine.Render(path, writer, ps)
 }
 
-func RenderView(tpl string, writer io.Writer, ps Params) (err error) {
-	doc, err := buildTemplate(tpl)
-	if err != nil {
-		return
-	}
-	body, err := doc.execute(ps)
-	if err != nil {
-		return
-	}
-
-	_, err = writer.Write([]byte(body))
-
-	return
+func RenderContext(ctx context.Context, path string, writer io.Writer, ps Params) error {
+	return defaultEngine.RenderContext(ctx, path, writer, ps)
 }
 
-func WarmUp() (err error) {
-	if config == nil || config.TplDir == "" || config.ExtName == "" {
-		return errors.New("template: template dir or template extension name isn't configured")
-	}
-	suffix := "." + config.ExtName
-	err = filepath.Walk(filepath.Join(pwd, config.TplDir), func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			if strings.HasSuffix(info.Name(), suffix) {
-				if _, err = buildFileTemplate(path); err != nil {
-					return err
-				}
-			}
-		}
+func RenderView(tpl string, writer io.Writer, ps Params) error {
+	return defaultEngine.RenderView(tpl, writer, ps)
+}
 
-		return nil
-	})
+func RenderViewContext(ctx context.Context, tpl string, writer io.Writer, ps Params) error {
+	return defaultEngine.RenderViewContext(ctx, tpl, writer, ps)
+}
 
-	return
+func WarmUp() error {
+	return defaultEngine.WarmUp()
 }
 
-func resolvePath(p string) string {
-	if p == "" {
-		return p
-	}
-	if config == nil {
-		p = filepath.Join(pwd, p)
-	} else {
-		p = filepath.Join(pwd, config.TplDir, p)
-	}
+func Validate(name string) error {
+	return defaultEngine.Validate(name)
+}
 
-	return path.Clean(p)
+func Lint(name string) error {
+	return defaultEngine.Lint(name)
 }
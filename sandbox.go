@@ -2,7 +2,6 @@ package template
 
 import (
 	"fmt"
-	"path/filepath"
 	"strings"
 	"sync"
 
@@ -28,7 +27,7 @@ var (
 		"and": 12,
 	}
 
-	internalKeyWords = "_block_endblock_set_if_elseif_else_endif_for_endfor_extend_include_in_and_or_not_with_"
+	internalKeyWords = "_block_endblock_set_if_elseif_else_endif_for_endfor_break_continue_extend_include_autoescape_endautoescape_macro_endmacro_import_from_in_and_or_not_with_"
 
 	sandboxPool = sync.Pool{
 		New: func() any {
@@ -43,42 +42,113 @@ var (
 	}
 )
 
-func buildTemplate(content string) (*Document, error) {
+func (e *Engine) buildTemplate(content string) (*Document, error) {
 	source := newSourceCode(content)
 
-	return buildSource(source)
+	return e.buildSource(source)
 }
 
-func buildFileTemplate(path string) (doc *Document, err error) {
+func (e *Engine) buildFileTemplate(name string) (doc *Document, err error) {
+	name = cleanName(name)
+	if doc = e.cache.doc(name); doc != nil {
+		if !e.autoReload() || e.fresh(doc, make(map[string]bool)) {
+			return doc, nil
+		}
+	}
 	var source *sourceCode
-	source, err = newSourceCodeFile(path)
+	source, err = loadSourceCode(e.getLoader(), name)
 	if err != nil {
 		return nil, err
 	}
-	doc, err = buildSource(source)
+	if doc != nil {
+		return e.compile(source)
+	}
 
-	return
+	return e.buildSource(source)
 }
 
-func buildSource(source *sourceCode) (*Document, error) {
-	if doc := _cache.doc(source.identity); doc != nil {
-		return doc, nil
+func (e *Engine) buildSource(source *sourceCode) (*Document, error) {
+	if doc := e.cache.doc(source.identity); doc != nil {
+		if !e.autoReload() || e.fresh(doc, make(map[string]bool)) {
+			return doc, nil
+		}
 	}
 
-	if stream, err := tokenize(source); err != nil {
+	return e.compile(source)
+}
+
+// compile builds source into a document and caches it, replacing the cached
+// document of the same source in auto reload mode.
+func (e *Engine) compile(source *sourceCode) (*Document, error) {
+	stream, err := tokenize(source, e.config)
+	if err != nil {
 		return nil, err
-	} else {
-		doc := newDocument()
-		err = build(doc, stream)
-		_cache.addDoc(source.identity, doc)
+	}
+	doc := newDocument(e, source.name)
+	doc.hash = abstract([]byte(source.code))
+	if err = e.build(doc, stream); err != nil {
+		return nil, err
+	}
+	if e.autoReload() {
+		e.cache.setDoc(source.identity, doc)
+	} else if err = e.cache.addDoc(source.identity, doc); err != nil {
+		// the document was built concurrently, the cached one is kept
+		if cached := e.cache.doc(source.identity); cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// fresh reports whether the source of doc and of the documents it extends
+// or includes are unchanged since they were built, and whether doc is built
+// with the documents cached for its deps. checked memorizes the names
+// already compared. The source of a view, which has no name, is its cache
+// key, so only its deps are compared.
+func (e *Engine) fresh(doc *Document, checked map[string]bool) bool {
+	if doc.name != "" {
+		if fresh, ok := checked[doc.name]; ok {
+			return fresh
+		}
+		checked[doc.name] = false
+		code, err := e.getLoader().Load(doc.name)
+		if err != nil || abstract([]byte(code)) != doc.hash {
+			return false
+		}
+	}
+	for _, name := range doc.deps {
+		dep := e.cache.doc(name)
+		if dep == nil || dep != doc.uses[name] || !e.fresh(dep, checked) {
+			return false
+		}
+	}
+	if doc.name != "" {
+		checked[doc.name] = true
+	}
 
-		return doc, err
+	return true
+}
+
+// dependency builds the document at the path tok, which doc extends,
+// includes or imports.
+func (sb *sandbox) dependency(doc *Document, tok *token) (*Document, error) {
+	name := cleanName(trimString(tok.value))
+	doc.deps = append(doc.deps, name)
+	dep, err := sb.engine.buildFileTemplate(name)
+	if err != nil {
+		return nil, err
 	}
+	doc.uses[name] = dep
+
+	return dep, nil
 }
 
-func build(doc *Document, stream *tokenStream) error {
+func (e *Engine) build(doc *Document, stream *tokenStream) error {
 	sb := getSandbox()
 	defer putSandbox(sb)
+	sb.engine = e
 	err := sb.build(doc, stream)
 
 	return err
@@ -113,12 +183,17 @@ func putExprSandbox(sb *exprSandbox) {
 }
 
 type sandbox struct {
+	engine *Engine
+	html   *htmlContext // context of html templates; nil if not escaped
 	cursor appendAble
 	stack  []appendAble
 }
 
 func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 	sb.cursor = doc
+	if isHTMLName(doc.name) {
+		sb.html = &htmlContext{}
+	}
 	var (
 		tok       *token
 		err       error
@@ -145,6 +220,9 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 		case type_text:
 			node = &textDirect{text: &basicLit{kind: type_string, value: tok}}
 			sb.cursor.append(node)
+			if sb.html != nil {
+				sb.html.feed(tok.value)
+			}
 
 		case type_var_start:
 			if subStream, err = subStreamIf(stream, func(t *token) bool {
@@ -158,6 +236,13 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 					return err
 				}
 				node = &valueDirect{tok: box.expr}
+				if sb.html != nil {
+					node.(*valueDirect).esc = sb.html.escaper()
+				}
+				if section := sb.autoescape(); section != nil {
+					node.(*valueDirect).esc = section.esc
+					node.(*valueDirect).declared = true
+				}
 				sb.cursor.append(node)
 			}
 
@@ -180,23 +265,45 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 				sb.cursor = sb.popsStack()
 
 			case "endfor":
-				if _, ok = sb.cursor.(*forDirect); !ok {
+				d, ok := sb.cursor.(*forDirect)
+				if !ok {
 					return newUnexpectedToken(tok)
 				}
+				d.loop = refersLoop(d.body)
 				sb.cursor = sb.popsStack()
 
+			case "endautoescape":
+				if _, ok = sb.cursor.(*autoescapeDirect); !ok {
+					return newUnexpectedToken(tok)
+				}
+				sb.cursor = sb.popsStack()
+
+			case "autoescape":
+				node = &autoescapeDirect{strategy: tok, esc: escape_html}
+				if tok, err = stream.next(); err != nil {
+					return err
+				}
+				switch tok.typ {
+				case type_string, type_bool:
+					if node.(*autoescapeDirect).esc, ok = escaperOf(trimString(tok.value)); !ok {
+						return newUnexpectedToken(tok)
+					}
+					node.(*autoescapeDirect).strategy = tok
+				case type_command_end:
+				default:
+					return newUnexpectedToken(tok)
+				}
+				sb.cursor.append(node)
+				sb.cursor = sb.pushStack(node.(*autoescapeDirect))
+
 			case "extend":
 				node = &extendDirect{}
 				if tok, err = nextTokenTypeShouldBe(stream, type_string); err != nil {
 					return err
 				}
 				node.(*extendDirect).path = &basicLit{kind: tok.typ, value: tok}
-				path := trimString(tok.value)
-				if config != nil && config.TplDir != "" {
-					path = filepath.Join(config.TplDir, path)
-				}
-				if baseDoc, err := buildFileTemplate(path); err != nil {
-					return err
+				if baseDoc, err := sb.dependency(doc, tok); err != nil {
+					return enter(err, "extend", tok)
 				} else {
 					baseDoc.extended = true
 					node.(*extendDirect).doc = baseDoc
@@ -209,12 +316,8 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 					return err
 				}
 				node.(*includeDirect).path = &basicLit{kind: tok.typ, value: tok}
-				path := trimString(tok.value)
-				if config != nil && config.TplDir != "" {
-					path = filepath.Join(config.TplDir, path)
-				}
-				if baseDoc, err = buildFileTemplate(path); err != nil {
-					return err
+				if baseDoc, err = sb.dependency(doc, tok); err != nil {
+					return enter(err, "include", tok)
 				} else {
 					node.(*includeDirect).doc = baseDoc
 				}
@@ -248,12 +351,69 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 				}
 				node = &blockDirect{name: &basicLit{kind: type_string, value: tok}}
 				if _, ok := doc.blocks[tok.value]; ok {
-					return errors.Errorf("block %s has already exist", tok.value)
+					return newSyntaxError(CodeDuplicateBlock, tok, "block %s has already exist", tok.value)
 				}
 				doc.blocks[tok.value] = node.(*blockDirect)
 				sb.cursor.append(node)
 				sb.cursor = sb.pushStack(node.(*blockDirect))
 
+			case "endmacro":
+				if _, ok = sb.cursor.(*macroDirect); !ok {
+					return newUnexpectedToken(tok)
+				}
+				sb.cursor = sb.popsStack()
+
+			case "macro":
+				if tok, err = nextTokenTypeShouldBe(stream, type_name); err != nil {
+					return err
+				}
+				node = &macroDirect{name: tok, doc: doc}
+				if _, ok := doc.macros[tok.value]; ok {
+					return newSyntaxError(CodeDuplicateMacro, tok, "macro %s has already exist", tok.value)
+				}
+				if _, err = nextTokenValueShouldBe(stream, "("); err != nil {
+					return err
+				}
+				if err = sb.buildMacroParams(node.(*macroDirect), stream); err != nil {
+					return err
+				}
+				doc.macros[node.(*macroDirect).name.value] = node.(*macroDirect)
+				sb.cursor.append(node)
+				sb.cursor = sb.pushStack(node.(*macroDirect))
+
+			case "import":
+				if tok, err = nextTokenTypeShouldBe(stream, type_string); err != nil {
+					return err
+				}
+				node = &importDirect{path: &basicLit{kind: tok.typ, value: tok}}
+				if node.(*importDirect).doc, err = sb.dependency(doc, tok); err != nil {
+					return enter(err, "import", tok)
+				}
+				if _, err = nextTokenValueShouldBe(stream, "as"); err != nil {
+					return err
+				}
+				if tok, err = nextTokenTypeShouldBe(stream, type_name); err != nil {
+					return err
+				}
+				node.(*importDirect).alias = &ident{name: tok}
+				sb.cursor.append(node)
+
+			case "from":
+				if tok, err = nextTokenTypeShouldBe(stream, type_string); err != nil {
+					return err
+				}
+				node = &fromDirect{path: &basicLit{kind: tok.typ, value: tok}}
+				if node.(*fromDirect).doc, err = sb.dependency(doc, tok); err != nil {
+					return enter(err, "import", tok)
+				}
+				if _, err = nextTokenValueShouldBe(stream, "import"); err != nil {
+					return err
+				}
+				if err = sb.buildImportNames(node.(*fromDirect), stream); err != nil {
+					return err
+				}
+				sb.cursor.append(node)
+
 			case "set":
 				node = &assignDirect{}
 				if tok, err = nextTokenTypeShouldBe(stream, type_name); err != nil {
@@ -291,17 +451,23 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 				if err = box.build(subStream); err != nil {
 					return err
 				}
-				node = &ifDirect{}
+				node = &ifDirect{body: &sectionDirect{}}
 				node.(*ifDirect).cond = box.expr
 				ifNode.el = node
 				sb.shiftStack(node.(*ifDirect))
 
 			case "else":
-				_, ok := sb.cursor.(*ifDirect)
-				if !ok {
+				switch cursor := sb.cursor.(type) {
+				case *ifDirect:
+					cursor.el = &sectionDirect{}
+				case *forDirect:
+					if cursor.el != nil {
+						return newUnexpectedToken(tok)
+					}
+					cursor.el = &sectionDirect{}
+				default:
 					return newUnexpectedToken(tok)
 				}
-				sb.cursor.(*ifDirect).el = &sectionDirect{}
 
 			case "if":
 				if subStream, err = subStreamIf(stream, func(t *token) bool {
@@ -309,7 +475,7 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 				}); err != nil {
 					return err
 				}
-				node = &ifDirect{}
+				node = &ifDirect{body: &sectionDirect{}}
 				box = getExprSandbox()
 				boxes = append(boxes, box)
 				if err = box.build(subStream); err != nil {
@@ -325,7 +491,7 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 				}); err != nil {
 					return err
 				}
-				node = &forDirect{}
+				node = &forDirect{body: &sectionDirect{}}
 				switch subStream.size() {
 				case 1:
 					if tok, err = nextTokenTypeShouldBe(subStream, type_name); err != nil {
@@ -345,11 +511,11 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 					}
 					node.(*forDirect).value = &ident{name: tok}
 				default:
-					return errors.Errorf("Unexpected arg list %s in for loop", subStream.string())
+					return newSyntaxError(CodeUnexpectedToken, subStream.tokens[0], "Unexpected arg list %s in for loop", subStream.string())
 				}
 
 				if subStream, err = subStreamIf(stream, func(t *token) bool {
-					return t.typ != type_command_end
+					return t.typ != type_command_end && t.value != "if"
 				}); err != nil {
 					return err
 				}
@@ -359,9 +525,36 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 					return err
 				}
 				node.(*forDirect).x = box.expr
+				if tok, err = stream.current(); err != nil {
+					return err
+				} else if tok.value == "if" {
+					if subStream, err = subStreamIf(stream, func(t *token) bool {
+						return t.typ != type_command_end
+					}); err != nil {
+						return err
+					}
+					box = getExprSandbox()
+					boxes = append(boxes, box)
+					if err = box.build(subStream); err != nil {
+						return err
+					}
+					node.(*forDirect).cond = box.expr
+				}
 				sb.cursor.append(node)
 				sb.cursor = sb.pushStack(node.(*forDirect))
 
+			case "break", "continue":
+				var cond expr
+				if cond, err = buildJumpCond(stream); err != nil {
+					return err
+				}
+				if tok.value == "break" {
+					node = &breakDirect{tok: tok, cond: cond}
+				} else {
+					node = &continueDirect{tok: tok, cond: cond}
+				}
+				sb.cursor.append(node)
+
 			default:
 				return newUnexpectedToken(tok)
 
@@ -379,6 +572,156 @@ func (sb *sandbox) build(doc *Document, stream *tokenStream) error {
 	return nil
 }
 
+// buildJumpCond builds the optional condition of a break or continue direct,
+// such as `if i > 10`.
+func buildJumpCond(stream *tokenStream) (expr, error) {
+	tok, err := stream.peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if tok.typ == type_command_end {
+		return nil, nil
+	}
+	if _, err = nextTokenValueShouldBe(stream, "if"); err != nil {
+		return nil, err
+	}
+	subStream, err := subStreamIf(stream, func(t *token) bool {
+		return t.typ != type_command_end
+	})
+	if err != nil {
+		return nil, err
+	}
+	box := getExprSandbox()
+	defer putExprSandbox(box)
+	if err = box.build(subStream); err != nil {
+		return nil, err
+	}
+
+	return box.expr, nil
+}
+
+// buildMacroParams builds the parameter list of a macro, following its
+// opening bracket, such as `name, type="text")`.
+func (sb *sandbox) buildMacroParams(node *macroDirect, stream *tokenStream) error {
+	var (
+		tok       *token
+		err       error
+		subStream *tokenStream
+	)
+	if tok, err = stream.peek(1); err != nil {
+		return err
+	} else if tok.value == ")" {
+		_, err = stream.next()
+
+		return err
+	}
+	for {
+		if tok, err = nextTokenTypeShouldBe(stream, type_name); err != nil {
+			return err
+		}
+		node.params = append(node.params, &ident{name: tok})
+		if tok, err = stream.next(); err != nil {
+			return err
+		}
+		var def expr
+		if tok.value == "=" {
+			depth := 0
+			if subStream, err = subStreamIf(stream, func(t *token) bool {
+				switch t.value {
+				case "(", "[":
+					depth++
+				case ")", "]":
+					if depth == 0 {
+						return false
+					}
+					depth--
+				case ",":
+					return depth > 0
+				}
+
+				return t.typ != type_command_end
+			}); err != nil {
+				return err
+			}
+			box := getExprSandbox()
+			err = box.build(subStream)
+			def = box.expr
+			putExprSandbox(box)
+			if err != nil {
+				return err
+			}
+			if tok, err = stream.current(); err != nil {
+				return err
+			}
+		}
+		node.defaults = append(node.defaults, def)
+
+		switch tok.value {
+		case ")":
+			return nil
+		case ",":
+		default:
+			return newUnexpectedToken(tok)
+		}
+	}
+}
+
+// buildImportNames builds the list of macros imported by a from direct, such
+// as `field, button as btn`.
+func (sb *sandbox) buildImportNames(node *fromDirect, stream *tokenStream) error {
+	var (
+		tok *token
+		err error
+	)
+	for {
+		if tok, err = nextTokenTypeShouldBe(stream, type_name); err != nil {
+			return err
+		}
+		if _, ok := node.doc.macros[tok.value]; !ok {
+			err := newUndefinedError(CodeUndefinedMacro, tok, tok.value)
+			err.Err = errors.Errorf("it isn't defined in %s", node.path.value.value)
+			return err
+		}
+		name, alias := &ident{name: tok}, &ident{name: tok}
+		if tok, err = stream.next(); err != nil {
+			return err
+		}
+		if tok.value == "as" {
+			if tok, err = nextTokenTypeShouldBe(stream, type_name); err != nil {
+				return err
+			}
+			alias = &ident{name: tok}
+			if tok, err = stream.next(); err != nil {
+				return err
+			}
+		}
+		node.names = append(node.names, name)
+		node.aliases = append(node.aliases, alias)
+
+		switch {
+		case tok.typ == type_command_end:
+			return nil
+		case tok.value == ",":
+		default:
+			return newUnexpectedToken(tok)
+		}
+	}
+}
+
+// autoescape returns the innermost autoescape section being built, or nil.
+func (sb *sandbox) autoescape() *autoescapeDirect {
+	if section, ok := sb.cursor.(*autoescapeDirect); ok {
+		return section
+	}
+	for i := len(sb.stack) - 1; i >= 0; i-- {
+		if section, ok := sb.stack[i].(*autoescapeDirect); ok {
+			return section
+		}
+	}
+
+	return nil
+}
+
 func (sb *sandbox) pushStack(node appendAble) appendAble {
 	sb.stack = append(sb.stack, sb.cursor)
 
@@ -397,6 +740,8 @@ func (sb *sandbox) shiftStack(node appendAble) {
 }
 
 func (sb *sandbox) reset() {
+	sb.engine = nil
+	sb.html = nil
 	sb.cursor = nil
 	sb.stack = sb.stack[0:0]
 }
@@ -409,7 +754,7 @@ type exprSandbox struct {
 
 func (esb *exprSandbox) build(stream *tokenStream) error {
 	if stream.size() == 0 {
-		return errors.New("empty stream")
+		return stream.eof()
 	}
 	var (
 		topOp *token
@@ -520,7 +865,7 @@ func (esb *exprSandbox) build(stream *tokenStream) error {
 	}
 
 	if len(esb.exprsStack) != 1 {
-		return errors.Errorf("parse expr failed1: %s", stream.string())
+		return newSyntaxError(CodeInvalidExpr, stream.tokens[0], "parse expr failed: %s", stream.string())
 	}
 	esb.expr = esb.exprsStack[0]
 
@@ -559,7 +904,7 @@ func (esb *exprSandbox) mergeExprsStack(tok *token) error {
 		)
 		switch tok.value {
 
-		case "+", "-", "*", "/", ">", "==", "<", ">=", "<=", "and", "or":
+		case "+", "-", "*", "/", ">", "==", "!=", "<", ">=", "<=", "and", "or":
 			esb.exprsStack = esb.exprsStack[:len2]
 			esb.exprsStack = append(esb.exprsStack, &binaryExpr{x: expr2, op: tok, y: expr1})
 
@@ -581,6 +926,8 @@ func (esb *exprSandbox) mergeExprsStack(tok *token) error {
 			)
 			if lExpr, ok = expr1.(*listExpr); ok {
 				lExpr.list = append([]expr{expr2}, lExpr.list...)
+			} else if lExpr, ok = expr2.(*listExpr); ok {
+				lExpr.list = append(lExpr.list, expr1)
 			} else {
 				lExpr = &listExpr{}
 				lExpr.list = append(lExpr.list, expr1)
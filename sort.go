@@ -0,0 +1,152 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var compareMapType = reflect.TypeOf((*compareMap)(nil))
+
+// compareMap holds the funcs ordering the values of the types they're
+// registered for. Filters ordering values take the compareMap of the engine
+// rendering them as first argument.
+type compareMap struct {
+	store  map[reflect.Type]func(x, y any) int
+	locker *sync.RWMutex
+}
+
+func newCompareMap() *compareMap {
+	return &compareMap{
+		store:  make(map[reflect.Type]func(x, y any) int),
+		locker: &sync.RWMutex{},
+	}
+}
+
+// RegisterCompare sets the function ordering the values of type T in the
+// templates rendered by the default engine, see Engine.RegisterCompare.
+func RegisterCompare[T any](cmp func(x, y T) int) error {
+	return defaultEngine.RegisterCompare(cmp)
+}
+
+func (cm *compareMap) register(cmp any) error {
+	fn := reflect.ValueOf(cmp)
+	if fn.Kind() != reflect.Func {
+		return errors.Errorf("can't register %T as compare func", cmp)
+	}
+	typ := fn.Type()
+	if typ.NumIn() != 2 || typ.In(0) != typ.In(1) || typ.IsVariadic() || typ.NumOut() != 1 || typ.Out(0).Kind() != reflect.Int {
+		return errors.Errorf("can't register %s as compare func; should be func(x, y T) int", typ)
+	}
+	cm.locker.Lock()
+	defer cm.locker.Unlock()
+	cm.store[typ.In(0)] = func(x, y any) int {
+		return int(fn.Call([]reflect.Value{reflect.ValueOf(x), reflect.ValueOf(y)})[0].Int())
+	}
+
+	return nil
+}
+
+func (cm *compareMap) get(typ reflect.Type) func(x, y any) int {
+	cm.locker.RLock()
+	defer cm.locker.RUnlock()
+
+	return cm.store[typ]
+}
+
+// order compares x and y. Strings and numbers are in their natural order,
+// the other types use the function registered in cm, and fall back to the
+// order of their formatted values.
+func (cm *compareMap) order(x, y any) int {
+	vx, vy := reflect.ValueOf(x), reflect.ValueOf(y)
+	if !vx.IsValid() || !vy.IsValid() {
+		return compareInt(boolInt(vx.IsValid()), boolInt(vy.IsValid()))
+	}
+	if vx.Type() == vy.Type() {
+		if cmp := cm.get(vx.Type()); cmp != nil {
+			return cmp(x, y)
+		}
+	}
+	switch kx, ky := vx.Kind(), vy.Kind(); {
+	case isIntLike(kx) && isIntLike(ky):
+		return compareInt(vx.Int(), vy.Int())
+	case isUintLike(kx) && isUintLike(ky):
+		return compareInt(vx.Uint(), vy.Uint())
+	case isNumber(kx) && isNumber(ky):
+		return compareInt(floatOf(vx), floatOf(vy))
+	case kx == reflect.String && ky == reflect.String:
+		return strings.Compare(vx.String(), vy.String())
+	case kx == reflect.Bool && ky == reflect.Bool:
+		return compareInt(boolInt(vx.Bool()), boolInt(vy.Bool()))
+	case vx.Type() != vy.Type():
+		return strings.Compare(vx.Type().String(), vy.Type().String())
+	}
+
+	return strings.Compare(fmt.Sprint(x), fmt.Sprint(y))
+}
+
+func floatOf(v reflect.Value) float64 {
+	switch {
+	case isIntLike(v.Kind()):
+		return float64(v.Int())
+	case isUintLike(v.Kind()):
+		return float64(v.Uint())
+	}
+
+	return v.Float()
+}
+
+func compareInt[T int | int64 | uint64 | float64](x, y T) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// sortedMap holds the entries of a map in the order a for loop ranges over
+// them.
+type sortedMap []forItem
+
+// sortItems sorts items by key.
+func (cm *compareMap) sortItems(items []forItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return cm.order(items[i].key, items[j].key) < 0
+	})
+}
+
+// sortby returns the entries of the map m sorted by "key", the default, or by
+// "value". The entries having equal values stay sorted by key.
+func sortby(cm *compareMap, m any, by ...string) (sortedMap, error) {
+	v := uncoverInterface(reflect.ValueOf(m))
+	if v.Kind() != reflect.Map {
+		return nil, errors.Errorf("can't sort %T by key or value", m)
+	}
+	items := entries(cm, v)
+	if len(by) == 0 || by[0] == "key" {
+		return items, nil
+	}
+	if by[0] != "value" {
+		return nil, errors.Errorf("can't sort by %s; should be key or value", by[0])
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return cm.order(items[i].value, items[j].value) < 0
+	})
+
+	return items, nil
+}
@@ -3,59 +3,91 @@ package template
 import (
 	"crypto/sha1"
 	"encoding/hex"
-	"os"
+	"fmt"
+	"strconv"
+	"strings"
 )
 
 type sourceCode struct {
 	identity string
+	name     string // name of the template; empty for views
 	code     string
 }
 
-// type textLine struct {
-// 	num       int
-// 	code      string
-// 	highlight bool
-// }
+type textLine struct {
+	num       int
+	code      string
+	highlight bool
+}
+
+// overview returns the lines near line.
+func (s *sourceCode) overview(line int) (codes []*textLine) {
+	lines := strings.Split(reg_enter.ReplaceAllString(s.code, "\n"), "\n")
+	if line < 1 || line > len(lines) {
+		return nil
+	}
+	startLine, endLine := line-2, line+2
+	if startLine < 1 {
+		startLine = 1
+	}
+	if endLine > len(lines) {
+		endLine = len(lines)
+	}
+	for i := startLine; i <= endLine; i++ {
+		codes = append(codes, &textLine{num: i, code: lines[i-1], highlight: i == line})
+	}
+
+	return
+}
 
-// Overview returns nearby code
-// func (s *sourceCode) overview(line int) (codes []*textLine) {
-// 	pos := reg_enter.FindAllStringIndex(s.code, -1)
-// 	len := len(pos)
-// 	if line < 0 {
-// 		return nil
-// 	}
-// 	if len < line || len == 0 {
-// 		return nil
-// 	}
-// 	var (
-// 		startLine, endLine int
-// 	)
-// 	endLine = line + 5
-// 	if endLine > len {
-// 		endLine = len
-// 	}
-// 	startLine = line - 5
-// 	if startLine < 1 {
-// 		startLine = 1
-// 	}
-// 	for i := startLine; i < endLine; i++ {
-// 		codes = append(codes, &textLine{num: i, code: s.code[pos[i-1][1]:pos[i][0]], highlight: i == line})
-// 	}
+// snippet renders the lines near line, the highlighted one is marked and
+// followed by a caret under col.
+func (s *sourceCode) snippet(line, col int) string {
+	codes := s.overview(line)
+	if len(codes) == 0 {
+		return ""
+	}
+	width := len(strconv.Itoa(codes[len(codes)-1].num))
+	sb := &strings.Builder{}
+	for _, c := range codes {
+		mark := " "
+		if c.highlight {
+			mark = ">"
+		}
+		fmt.Fprintf(sb, "%s %*d | %s\n", mark, width, c.num, c.code)
+		if c.highlight && col > 0 {
+			fmt.Fprintf(sb, "  %*s | %s^\n", width, "", blanks(c.code, col-1))
+		}
+	}
 
-// 	return
-// }
+	return sb.String()
+}
+
+// blanks returns blanks as wide as the first n bytes of code, tabs are kept
+// so that the caret lines up.
+func blanks(code string, n int) string {
+	if n > len(code) {
+		n = len(code)
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, code[:n])
+}
 
 func newSourceCode(code string) *sourceCode {
 	return &sourceCode{code: code, identity: abstract([]byte(code))}
 }
 
-func newSourceCodeFile(path string) (*sourceCode, error) {
-	bs, err := os.ReadFile(path)
+func loadSourceCode(loader Loader, name string) (*sourceCode, error) {
+	code, err := loader.Load(name)
 	if err != nil {
-		return nil, err
+		return nil, &LoadError{Code: CodeLoadFailed, Template: name, Err: err}
 	}
 
-	return &sourceCode{code: string(bs), identity: path}, nil
+	return &sourceCode{code: code, identity: name, name: name}, nil
 }
 
 func abstract(content []byte) string {
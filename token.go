@@ -18,6 +18,22 @@ type token struct {
 	value string
 	typ   int
 	line  int
+	col   int
+	src   *sourceCode // source the token is read from; or nil
+}
+
+// name returns the name of the template the token is read from.
+func (t *token) name() string {
+	if t.src == nil {
+		return ""
+	}
+
+	return t.src.name
+}
+
+// location returns the position of the token in its source.
+func (t *token) location() Location {
+	return Location{Name: t.name(), Line: t.line, Column: t.col, src: t.src}
 }
 
 func (t *token) string() string {
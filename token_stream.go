@@ -19,14 +19,14 @@ var (
 )
 
 var (
-	// }}
-	reg_variable = regexp.MustCompile(fmt.Sprintf(`\s*%s`, tag_variable[1]))
-	// %}
-	reg_block = regexp.MustCompile(fmt.Sprintf(`\s*%s`, tag_block[1]))
-	// #}
-	reg_comment = regexp.MustCompile(fmt.Sprintf(`\s*%s`, tag_comment[1]))
-	// {{ or {% or {#
-	reg_token_start = regexp.MustCompile(fmt.Sprintf(`(@?%s|@?%s|@?%s)`, tag_variable[0], tag_block[0], tag_comment[0]))
+	// }} or -}}
+	reg_variable = regexp.MustCompile(fmt.Sprintf(`\s*-?%s`, tag_variable[1]))
+	// %} or -%}
+	reg_block = regexp.MustCompile(fmt.Sprintf(`\s*-?%s`, tag_block[1]))
+	// #} or -#}
+	reg_comment = regexp.MustCompile(fmt.Sprintf(`\s*-?%s`, tag_comment[1]))
+	// {{ or {% or {#, followed by - to trim the whitespace before them
+	reg_token_start = regexp.MustCompile(fmt.Sprintf(`(@?%s|@?%s|@?%s)-?`, tag_variable[0], tag_block[0], tag_comment[0]))
 	// \r\n \n
 	reg_enter = regexp.MustCompile(`(\r\n|\n)`)
 	// whitespace
@@ -47,13 +47,22 @@ var (
 	reg_string = regexp.MustCompile(`^"([^"\\\\]*(?:\\\\.[^"\\\\]*)*)"|^'([^\'\\\\]*(?:\\\\.[^\'\\\\]*)*)'`)
 )
 
-func tokenize(source *sourceCode) (*tokenStream, error) {
+// tokenize splits source into tokens, the whitespace around tags is trimmed
+// as required by the tags and by the TrimBlocks and LstripBlocks options of
+// config, which may be nil.
+func tokenize(source *sourceCode, config *Config) (*tokenStream, error) {
 	var (
+		trimBlocks      = config != nil && config.TrimBlocks
+		lstripBlocks    = config != nil && config.LstripBlocks
+		trimNext        bool // trim the whitespace at the start of the next text
+		stripNewline    bool // strip the newline at the start of the next text
+		opener, closer  string
 		code            = reg_enter.ReplaceAllString(source.code, "\n")
 		stream          = &tokenStream{source: source, cursor: -1}
 		poss            = reg_token_start.FindAllStringIndex(code, -1)
 		cursor          = 0
-		line            = 0
+		line            = 1
+		col             = 1
 		posIndex        = 0
 		codeLen         = len(code)
 		pos, ends, sPos []int
@@ -65,12 +74,67 @@ func tokenize(source *sourceCode) (*tokenStream, error) {
 
 	moveCursor := func(n int) {
 		cursor = n
-		line = len(reg_enter.FindAllString(code[:n], -1)) + 1
+		line = strings.Count(code[:n], "\n") + 1
+		col = n - strings.LastIndexByte(code[:n], '\n')
+	}
+	newToken := func(typ int, value string, line int) *token {
+		return &token{typ: typ, value: value, line: line, col: col, src: source}
+	}
+	unclosed := func(tok string, line, col int) error {
+		return newSyntaxError(CodeUnclosedToken, &token{value: tok, line: line, col: col, src: source}, "Unclosed token \"%s\"", tok)
+	}
+	unexpected := func(tok string) error {
+		return newUnexpectedToken(newToken(type_text, tok, line))
+	}
+	// appendText appends the text at the cursor, trimmed as required by the
+	// tag before it.
+	appendText := func(start, stop int) {
+		text := code[start:stop]
+		if trimNext {
+			text = strings.TrimLeft(text, " \t\n")
+		} else if stripNewline {
+			text = strings.TrimPrefix(text, "\n")
+		}
+		trimNext, stripNewline = false, false
+		if text != "" {
+			at := stop - len(text)
+			stream.tokens = append(stream.tokens, &token{
+				typ:   type_text,
+				value: text,
+				line:  strings.Count(code[:at], "\n") + 1,
+				col:   at - strings.LastIndexByte(code[:at], '\n'),
+				src:   source,
+			})
+		}
+	}
+	// trimPrev trims the whitespace at the end of the text before a tag, or
+	// only the indentation of the tag if lstrip.
+	trimPrev := func(lstrip bool) {
+		if len(stream.tokens) == 0 {
+			return
+		}
+		last := stream.tokens[len(stream.tokens)-1]
+		if last.typ != type_text {
+			return
+		}
+		if !lstrip {
+			last.value = strings.TrimRight(last.value, " \t\n")
+		} else if i := strings.LastIndexByte(last.value, '\n'); strings.Trim(last.value[i+1:], " \t") == "" && (i >= 0 || last.col == 1) {
+			last.value = last.value[:i+1]
+		}
+		if last.value == "" {
+			stream.tokens = stream.tokens[:len(stream.tokens)-1]
+		}
+	}
+	// trimAfter records how the text after a tag ending with closer is
+	// trimmed.
+	trimAfter := func(closer string, block bool) {
+		trimNext = strings.HasPrefix(strings.TrimLeft(closer, " \t\n"), "-")
+		stripNewline = block && trimBlocks
 	}
 
 	if len(poss) == 0 {
-		tok = newToken(type_text, code[cursor:], line)
-		stream.tokens = append(stream.tokens, tok)
+		appendText(cursor, codeLen)
 		cursor = len(code)
 	}
 	for posIndex < len(poss) {
@@ -79,22 +143,31 @@ func tokenize(source *sourceCode) (*tokenStream, error) {
 			posIndex++
 			continue
 		} else if pos[0] > cursor {
-			tok = newToken(type_text, code[cursor:pos[0]], line)
-			stream.tokens = append(stream.tokens, tok)
+			appendText(cursor, pos[0])
 			moveCursor(pos[0])
 		}
 		var reg *regexp.Regexp
 
-		switch code[pos[0]:pos[1]] {
+		opener = code[pos[0]:pos[1]]
+		if strings.HasPrefix(opener, "@") {
+			// the - belongs to the escaped text
+			opener = strings.TrimSuffix(opener, "-")
+		} else if strings.HasSuffix(opener, "-") {
+			trimPrev(false)
+			opener = opener[:2]
+		} else if lstripBlocks && (opener == tag_block[0] || opener == tag_comment[0]) {
+			trimPrev(true)
+		}
+
+		switch opener {
 
 		case tag_escape_comment[0]:
 			moveCursor(pos[0] + 1)
 			ends = reg_comment.FindStringIndex(code[cursor:])
 			if ends == nil {
-				return nil, &UnClosedToken{Line: line, token: tag_escape_comment[0]}
+				return nil, unclosed(tag_escape_comment[0], line, col)
 			}
-			tok = newToken(type_text, code[cursor:cursor+ends[1]], line)
-			stream.tokens = append(stream.tokens, tok)
+			appendText(cursor, cursor+ends[1])
 			moveCursor(cursor + ends[1])
 			continue
 
@@ -102,10 +175,9 @@ func tokenize(source *sourceCode) (*tokenStream, error) {
 			moveCursor(pos[0] + 1)
 			ends = reg_block.FindStringIndex(code[cursor:])
 			if ends == nil {
-				return nil, &UnClosedToken{Line: line, token: tag_escape_block[0]}
+				return nil, unclosed(tag_escape_block[0], line, col)
 			}
-			tok = newToken(type_text, code[cursor:cursor+ends[1]], line)
-			stream.tokens = append(stream.tokens, tok)
+			appendText(cursor, cursor+ends[1])
 			moveCursor(cursor + ends[1])
 			continue
 
@@ -113,21 +185,22 @@ func tokenize(source *sourceCode) (*tokenStream, error) {
 			moveCursor(pos[0] + 1)
 			ends = reg_variable.FindStringIndex(code[cursor:])
 			if ends == nil {
-				return nil, &UnClosedToken{Line: line, token: tag_escape_variable[0]}
+				return nil, unclosed(tag_escape_variable[0], line, col)
 			}
-			tok = newToken(type_text, code[cursor:cursor+ends[1]], line)
-			stream.tokens = append(stream.tokens, tok)
+			appendText(cursor, cursor+ends[1])
 			moveCursor(cursor + ends[1])
 			continue
 
 		case tag_comment[0]:
-			ends = reg_comment.FindStringIndex(code[cursor:])
+			// comments are written out as they are
+			ends = reg_comment.FindStringIndex(code[pos[1]:])
 			if ends == nil {
-				return nil, &UnClosedToken{Line: line, token: tag_comment[0]}
+				return nil, unclosed(tag_comment[0], line, col)
 			}
-			tok = newToken(type_text, code[cursor:cursor+ends[1]], line)
-			stream.tokens = append(stream.tokens, tok)
-			moveCursor(cursor + ends[1])
+			appendText(pos[0], pos[1]+ends[1])
+			trimAfter(code[pos[1]+ends[0]:pos[1]+ends[1]], true)
+			moveCursor(pos[1] + ends[1])
+			posIndex++
 			continue
 
 		case tag_block[0]:
@@ -137,7 +210,7 @@ func tokenize(source *sourceCode) (*tokenStream, error) {
 			reg = reg_variable
 
 		default:
-			return nil, &UnexpectedToken{Line: line, token: code[pos[0]:pos[1]]}
+			return nil, unexpected(code[pos[0]:pos[1]])
 
 		}
 
@@ -147,10 +220,10 @@ func tokenize(source *sourceCode) (*tokenStream, error) {
 			tok = newToken(type_var_start, code[cursor:cursor+2], line)
 		}
 		stream.tokens = append(stream.tokens, tok)
-		moveCursor(cursor + 2)
+		moveCursor(pos[1])
 		ends = reg.FindStringIndex(code[cursor:])
 		if ends == nil {
-			return nil, &UnClosedToken{Line: line, token: tag_block[0]}
+			return nil, unclosed(tok.value, tok.line, tok.col)
 		}
 		length = ends[1] - ends[0]
 		end = cursor + ends[0]
@@ -166,18 +239,15 @@ func tokenize(source *sourceCode) (*tokenStream, error) {
 				moveCursor(cursor + sPos[1])
 			} else if sPos = reg_word.FindStringIndex(code[cursor:end]); sPos != nil {
 				word = code[cursor : cursor+sPos[1]]
-				moveCursor(cursor + sPos[1])
 				if isWordOperator(word) {
 					tok = newToken(type_operator, word, line)
-					stream.tokens = append(stream.tokens, tok)
-					continue
 				} else if isBooleans(word) {
 					tok = newToken(type_bool, word, line)
-					stream.tokens = append(stream.tokens, tok)
-					continue
+				} else {
+					tok = newToken(type_name, word, line)
 				}
-				tok = newToken(type_name, word, line)
 				stream.tokens = append(stream.tokens, tok)
+				moveCursor(cursor + sPos[1])
 			} else if sPos = reg_number.FindStringIndex(code[cursor:end]); sPos != nil {
 				tok = newToken(type_number, code[cursor:cursor+sPos[1]], line)
 				stream.tokens = append(stream.tokens, tok)
@@ -193,18 +263,18 @@ func tokenize(source *sourceCode) (*tokenStream, error) {
 			} else if sPos = reg_bracket.FindStringIndex(code[cursor:end]); sPos != nil {
 				bk = code[cursor+sPos[0] : cursor+sPos[1]]
 				if reg_bracket_open.MatchString(bk) {
-					bks = append(bks, &bracket{ch: bk, line: line})
+					bks = append(bks, &bracket{ch: bk, line: line, col: col})
 				} else if reg_bracket_close.MatchString(bk) {
 					if len(bk) == 0 {
-						return nil, &UnexpectedToken{Line: line, token: bk}
+						return nil, unexpected(bk)
 					}
 					switch {
 					case bks[len(bks)-1].ch == "(" && bk != ")":
-						return nil, &UnexpectedToken{Line: line, token: bk}
+						return nil, unexpected(bk)
 					case bks[len(bks)-1].ch == "[" && bk != "]":
-						return nil, &UnexpectedToken{Line: line, token: bk}
+						return nil, unexpected(bk)
 					case bks[len(bks)-1].ch == "{" && bk != "}":
-						return nil, &UnexpectedToken{Line: line, token: bk}
+						return nil, unexpected(bk)
 					}
 					bks = bks[:len(bks)-1]
 				}
@@ -212,40 +282,38 @@ func tokenize(source *sourceCode) (*tokenStream, error) {
 				stream.tokens = append(stream.tokens, tok)
 				moveCursor(cursor + sPos[1])
 			} else {
-				return nil, &UnexpectedToken{Line: line, token: code[cursor:end]}
+				return nil, unexpected(code[cursor:end])
 			}
 		}
 		if len(bks) > 0 {
-			return nil, &UnClosedToken{Line: bks[0].line, token: bks[0].ch}
+			return nil, unclosed(bks[0].ch, bks[0].line, bks[0].col)
 		}
 		moveCursor(end)
+		closer = code[cursor : cursor+length]
 		if reg == reg_block {
-			tok = newToken(type_command_end, code[cursor:cursor+length], line)
+			tok = newToken(type_command_end, closer, line)
 		} else {
-			tok = newToken(type_var_end, code[cursor:cursor+length], line)
+			tok = newToken(type_var_end, closer, line)
 		}
 		stream.tokens = append(stream.tokens, tok)
+		trimAfter(closer, reg == reg_block)
 		moveCursor(cursor + length)
 
 		posIndex++
 	}
 
 	if cursor < codeLen {
-		tok = newToken(type_text, code[cursor:codeLen], line)
-		stream.tokens = append(stream.tokens, tok)
+		appendText(cursor, codeLen)
 		moveCursor(codeLen)
 	}
 
 	return stream, nil
 }
 
-func newToken(typ int, value string, line int) *token {
-	return &token{typ: typ, value: value, line: line}
-}
-
 type bracket struct {
 	ch   string
 	line int
+	col  int
 }
 
 type tokenStream struct {
@@ -254,6 +322,22 @@ type tokenStream struct {
 	cursor int
 }
 
+// eof returns the error of reading beyond the last token, it's located at
+// the last token.
+func (ts *tokenStream) eof() error {
+	tok := &token{src: ts.source}
+	if len(ts.tokens) > 0 {
+		last := ts.tokens[len(ts.tokens)-1]
+		tok = &token{line: last.line, col: last.col + len(last.value), src: last.src}
+		if n := strings.Count(last.value, "\n"); n > 0 {
+			tok.line += n
+			tok.col = len(last.value) - strings.LastIndexByte(last.value, '\n')
+		}
+	}
+
+	return newSyntaxError(CodeUnexpectedEOF, tok, "Unexpected end of file")
+}
+
 func (ts *tokenStream) size() int {
 	return len(ts.tokens)
 }
@@ -269,7 +353,7 @@ func (ts *tokenStream) string() string {
 
 func (ts *tokenStream) current() (*token, error) {
 	if ts.cursor >= len(ts.tokens) {
-		return nil, &UnexpectedEndOfFile{}
+		return nil, ts.eof()
 	}
 
 	return ts.tokens[ts.cursor], nil
@@ -284,7 +368,7 @@ func (ts *tokenStream) hasNext() bool {
 func (ts *tokenStream) next() (*token, error) {
 	ts.cursor++
 	if ts.cursor > len(ts.tokens)-1 {
-		return nil, &UnexpectedEndOfFile{}
+		return nil, ts.eof()
 	}
 
 	return ts.tokens[ts.cursor], nil
@@ -293,7 +377,7 @@ func (ts *tokenStream) next() (*token, error) {
 func (ts *tokenStream) skip(n int) (*token, error) {
 	ts.cursor += n
 	if ts.cursor >= len(ts.tokens) {
-		return nil, &UnexpectedEndOfFile{}
+		return nil, ts.eof()
 	}
 
 	return ts.tokens[ts.cursor], nil
@@ -301,7 +385,7 @@ func (ts *tokenStream) skip(n int) (*token, error) {
 
 func (ts *tokenStream) peek(n int) (*token, error) {
 	if ts.cursor+n >= len(ts.tokens)-1 {
-		return nil, &UnexpectedEndOfFile{}
+		return nil, ts.eof()
 	}
 
 	return ts.tokens[ts.cursor+n], nil
@@ -2,26 +2,196 @@ package template
 
 import (
 	"reflect"
-
-	"github.com/pkg/errors"
 )
 
 var (
 
 	// expr type
-	identType      = reflect.TypeOf(&ident{}).Elem()
-	indexExprType  = reflect.TypeOf(&indexExpr{}).Elem()
-	listExprType   = reflect.TypeOf(&listExpr{}).Elem()
-	callExprType   = reflect.TypeOf(&callExpr{}).Elem()
-	binaryExprType = reflect.TypeOf(&binaryExpr{}).Elem()
+	identType      = reflect.TypeOf(&ident{})
+	indexExprType  = reflect.TypeOf(&indexExpr{})
+	listExprType   = reflect.TypeOf(&listExpr{})
+	callExprType   = reflect.TypeOf(&callExpr{})
+	binaryExprType = reflect.TypeOf(&binaryExpr{})
 
 	//direct type
-	sectionDirectType = reflect.TypeOf(&sectionDirect{}).Elem()
-	blockDirectType   = reflect.TypeOf(&blockDirect{}).Elem()
-	ifDirectType      = reflect.TypeOf(&ifDirect{}).Elem()
-	extendDirectType  = reflect.TypeOf(&extendDirect{}).Elem()
+	sectionDirectType = reflect.TypeOf(&sectionDirect{})
+	blockDirectType   = reflect.TypeOf(&blockDirect{})
+	ifDirectType      = reflect.TypeOf(&ifDirect{})
+	extendDirectType  = reflect.TypeOf(&extendDirect{})
 )
 
+// Validate builds the template of name and checks it together with the
+// templates it extends, includes or imports. All the problems found are
+// reported at once in an ErrorList, except for syntax errors stopping the
+// build which are returned alone.
+func (e *Engine) Validate(name string) error {
+	doc, err := e.buildFileTemplate(name)
+	if err != nil {
+		return err
+	}
+	var errs ErrorList
+	e.validate(doc, &errs, make(map[*Document]bool))
+
+	return errs.err()
+}
+
+func (e *Engine) validate(doc *Document, errs *ErrorList, checked map[*Document]bool) {
+	if checked[doc] {
+		return
+	}
+	checked[doc] = true
+	errs.add(doc.validate())
+	errs.add(e.resolve(doc))
+	for _, name := range doc.deps {
+		if dep := e.cache.doc(name); dep != nil {
+			e.validate(dep, errs, checked)
+		}
+	}
+}
+
+// resolve reports the funcs, filters and macros used by doc which don't
+// exist.
+func (e *Engine) resolve(doc *Document) error {
+	var (
+		errs   ErrorList
+		macros = make(map[string]bool)
+		spaces = make(map[string]macroNamespace)
+	)
+	for d := doc; d != nil; {
+		for name := range d.macros {
+			macros[name] = true
+		}
+		if d.extend == nil {
+			break
+		}
+		d = d.extend.doc
+	}
+	if doc.body != nil {
+		for _, x := range doc.body.list {
+			switch x := x.(type) {
+			case *importDirect:
+				spaces[x.alias.name.value] = x.doc.macros
+			case *fromDirect:
+				for _, alias := range x.aliases {
+					macros[alias.name.value] = true
+				}
+			}
+		}
+	}
+	walk(doc.body, func(n node) {
+		switch n := n.(type) {
+		case *pipelineExpr:
+			name := n.y.pos()
+			if x, ok := n.y.(*callExpr); ok {
+				name = x.fn.name
+			}
+			if e.filters.get(name.value) == zeroValue {
+				errs.add(newUndefinedError(CodeUndefinedFilter, name, name.value))
+			}
+		case *callExpr:
+			if !macros[n.fn.name.value] && e.funcs.get(n.fn.name.value) == zeroValue {
+				errs.add(newUndefinedError(CodeUndefinedFunc, n.fn.name, n.fn.name.value))
+			}
+		case *indexExpr:
+			x, ok := n.x.(*ident)
+			call, isCall := n.index.(*callExpr)
+			if !ok || !isCall || n.op.value != "." {
+				return
+			}
+			if ns, ok := spaces[x.name.value]; ok {
+				if _, ok := ns[call.fn.name.value]; !ok {
+					errs.add(newUndefinedError(CodeUndefinedMacro, call.fn.name, call.fn.name.value))
+				}
+			}
+		}
+	})
+
+	return errs.err()
+}
+
+// walk calls fn for n and each node nested in n, the documents referred by
+// includes, extends and imports aren't entered.
+func walk(n node, fn func(node)) {
+	if n == nil || reflect.ValueOf(n).IsNil() {
+		return
+	}
+	fn(n)
+	switch n := n.(type) {
+	case *listExpr:
+		for _, x := range n.list {
+			walk(x, fn)
+		}
+	case *indexExpr:
+		walk(n.x, fn)
+		if n.op.value == "[" {
+			walk(n.index, fn)
+		} else if call, ok := n.index.(*callExpr); ok && call.args != nil {
+			// the method itself isn't a func
+			walk(call.args, fn)
+		}
+	case *callExpr:
+		if n.args != nil {
+			walk(n.args, fn)
+		}
+	case *binaryExpr:
+		walk(n.x, fn)
+		walk(n.y, fn)
+	case *singleExpr:
+		walk(n.x, fn)
+	case *pipelineExpr:
+		walk(n.x, fn)
+		if call, ok := n.y.(*callExpr); ok && call.args != nil {
+			walk(call.args, fn)
+		}
+	case *valueDirect:
+		walk(n.tok, fn)
+	case *assignDirect:
+		walk(n.rh, fn)
+	case *sectionDirect:
+		for _, x := range n.list {
+			walk(x, fn)
+		}
+	case *ifDirect:
+		walk(n.cond, fn)
+		walk(n.body, fn)
+		if n.el != nil {
+			walk(n.el, fn)
+		}
+	case *forDirect:
+		walk(n.x, fn)
+		if n.cond != nil {
+			walk(n.cond, fn)
+		}
+		walk(n.body, fn)
+		if n.el != nil {
+			walk(n.el, fn)
+		}
+	case *breakDirect:
+		if n.cond != nil {
+			walk(n.cond, fn)
+		}
+	case *continueDirect:
+		if n.cond != nil {
+			walk(n.cond, fn)
+		}
+	case *blockDirect:
+		walk(n.body, fn)
+	case *includeDirect:
+		if n.params != nil {
+			walk(n.params, fn)
+		}
+	case *autoescapeDirect:
+		walk(n.body, fn)
+	case *macroDirect:
+		for _, x := range n.defaults {
+			if x != nil {
+				walk(x, fn)
+			}
+		}
+		walk(n.body, fn)
+	}
+}
+
 // ----------------------------------------------------------------------------
 // ExprNode validation
 
@@ -38,13 +208,12 @@ func (e *basicLit) validate() error {
 }
 
 func (e *listExpr) validate() error {
+	var errs ErrorList
 	for _, v := range e.list {
-		if err := v.validate(); err != nil {
-			return err
-		}
+		errs.add(v.validate())
 	}
 
-	return nil
+	return errs.err()
 }
 
 func (e *indexExpr) validate() error {
@@ -53,6 +222,10 @@ func (e *indexExpr) validate() error {
 		if !isType(e.index, identType, callExprType) {
 			return exprValidateError(e)
 		}
+		if call, ok := e.index.(*callExpr); ok {
+			// the name of a method isn't validated as a func
+			return reportValidateError(e.x.validate, call.validateArgs)
+		}
 	case "[":
 		if isType(e.index, listExprType) {
 			return exprValidateError(e)
@@ -65,7 +238,15 @@ func (e *indexExpr) validate() error {
 }
 
 func (e *callExpr) validate() error {
-	return reportValidateError(e.fn.validate, e.args.validate)
+	return reportValidateError(e.fn.validate, e.validateArgs)
+}
+
+func (e *callExpr) validateArgs() error {
+	if e.args == nil {
+		return nil
+	}
+
+	return e.args.validate()
 }
 
 func (e *binaryExpr) validate() error {
@@ -77,8 +258,7 @@ func (e *binaryExpr) validate() error {
 }
 
 func (e *singleExpr) validate() error {
-
-	if !isType(e.x, identType, indexExprType) {
+	if isType(e.x, listExprType) {
 		return exprValidateError(e)
 	}
 
@@ -100,14 +280,13 @@ func (d *assignDirect) validate() error {
 	return reportValidateError(d.lh.validate, d.rh.validate)
 }
 
-func (d *sectionDirect) validate() (err error) {
+func (d *sectionDirect) validate() error {
+	var errs ErrorList
 	for _, v := range d.list {
-		if err = v.validate(); err != nil {
-			return err
-		}
+		errs.add(v.validate())
 	}
 
-	return nil
+	return errs.err()
 }
 
 func (d *textDirect) validate() error {
@@ -119,81 +298,89 @@ func (d *valueDirect) validate() error {
 }
 
 func (d *ifDirect) validate() error {
-	if !isType(d.cond, identType, indexExprType, callExprType, binaryExprType) {
-		return exprValidateError(d.cond)
-	}
-
-	for _, v := range d.body.list {
-		if isType(v, blockDirectType, extendDirectType, sectionDirectType) {
-			return errors.Errorf("expected %s", d.el.typ())
-		}
+	var errs ErrorList
+	if isType(d.cond, listExprType) {
+		errs.add(exprValidateError(d.cond))
+	} else {
+		errs.add(d.cond.validate())
 	}
-
-	if err := reportValidateError(d.cond.validate, d.body.validate); err != nil {
-		return err
-	}
-
+	errs.add(misplaced(d, d.body, blockDirectType, extendDirectType, sectionDirectType))
+	errs.add(d.body.validate())
 	if d.el != nil {
 		if !isType(d.el, ifDirectType, sectionDirectType) {
-			return errors.Errorf("expected %s", d.el.typ())
+			errs.add(misplacedError(d.el, d))
+		} else {
+			errs.add(d.el.validate())
 		}
-
-		return d.el.validate()
 	}
 
-	return nil
+	return errs.err()
 }
 
 func (d *forDirect) validate() error {
+	var errs ErrorList
 	if d.key != nil {
-		if err := d.key.validate(); err != nil {
-			return exprValidateError(d.key)
-		}
+		errs.add(d.key.validate())
 	}
-
-	if !isType(d.x, identType, indexExprType, callExprType) {
-		return exprValidateError(d.x)
+	errs.add(d.value.validate())
+	if isType(d.x, listExprType) {
+		errs.add(exprValidateError(d.x))
+	} else {
+		errs.add(d.x.validate())
 	}
-
-	for _, v := range d.body.list {
-		if isType(v, blockDirectType, extendDirectType, sectionDirectType) {
-			return errors.Errorf("expected %s", v.typ())
-		}
+	if d.cond != nil {
+		errs.add(validateCond(d.cond))
+	}
+	errs.add(misplaced(d, d.body, blockDirectType, extendDirectType, sectionDirectType))
+	errs.add(d.body.validate())
+	if d.el != nil {
+		errs.add(misplaced(d, d.el, blockDirectType, extendDirectType, sectionDirectType))
+		errs.add(d.el.validate())
 	}
 
-	if err := reportValidateError(d.value.validate, d.x.validate); err != nil {
-		return err
+	return errs.err()
+}
+
+func (d *breakDirect) validate() error {
+	return validateCond(d.cond)
+}
+
+func (d *continueDirect) validate() error {
+	return validateCond(d.cond)
+}
+
+func validateCond(cond expr) error {
+	if cond == nil {
+		return nil
+	}
+	if isType(cond, listExprType) {
+		return exprValidateError(cond)
 	}
 
-	return d.body.validate()
+	return cond.validate()
 }
 
 func (d *blockDirect) validate() error {
-	for _, v := range d.body.list {
-		if isType(v, extendDirectType, sectionDirectType) {
-			return errors.Errorf("expected %s", v.typ())
-		}
+	if d.body == nil {
+		return d.name.validate()
 	}
 
-	return reportValidateError(d.name.validate, d.body.validate)
+	return reportValidateError(
+		func() error { return misplaced(d, d.body, extendDirectType, sectionDirectType) },
+		d.name.validate,
+		d.body.validate,
+	)
 }
 
 func (d *includeDirect) validate() error {
 	if err := d.path.validate(); err != nil {
 		return err
 	}
-
 	if d.doc.extend != nil {
-		return errors.New("con't use extend direct in included template")
+		return newSyntaxError(CodeMisplaced, d.path.value, "con't use extend direct in included template")
 	}
 
-	for _, v := range d.doc.body.list {
-		if isType(v, blockDirectType, extendDirectType, sectionDirectType) {
-			return errors.Errorf("expected %s", v.typ())
-		}
-	}
-
-	return d.doc.body.validate()
+	return misplaced(d, d.doc.body, blockDirectType, extendDirectType, sectionDirectType)
 }
 
 func (d *extendDirect) validate() error {
@@ -201,23 +388,55 @@ func (d *extendDirect) validate() error {
 		return err
 	}
 
-	for _, v := range d.doc.body.list {
-		if isType(v, extendDirectType) {
-			return errors.Errorf("expected %s", v.typ())
+	return misplaced(d, d.doc.body, extendDirectType)
+}
+
+func (d *autoescapeDirect) validate() error {
+	if d.body == nil {
+		return nil
+	}
+
+	return d.body.validate()
+}
+
+func (d *macroDirect) validate() error {
+	var errs ErrorList
+	for i, param := range d.params {
+		errs.add(param.validate())
+		if d.defaults[i] != nil {
+			errs.add(d.defaults[i].validate())
 		}
 	}
+	if d.body != nil {
+		errs.add(d.body.validate())
+	}
 
-	return d.doc.body.validate()
+	return errs.err()
 }
 
-func reportValidateError(fns ...func() error) (err error) {
+func (d *importDirect) validate() error {
+	return reportValidateError(d.path.validate, d.alias.validate)
+}
+
+func (d *fromDirect) validate() error {
+	var errs ErrorList
+	for i, name := range d.names {
+		errs.add(reportValidateError(name.validate, d.aliases[i].validate))
+	}
+	errs.add(d.path.validate())
+
+	return errs.err()
+}
+
+// reportValidateError runs all the validations and reports the problems
+// they found together.
+func reportValidateError(fns ...func() error) error {
+	var errs ErrorList
 	for _, fn := range fns {
-		if err = fn(); err != nil {
-			return err
-		}
+		errs.add(fn())
 	}
 
-	return nil
+	return errs.err()
 }
 
 func isType(expr node, typeList ...reflect.Type) bool {
@@ -230,6 +449,99 @@ func isType(expr node, typeList ...reflect.Type) bool {
 	return false
 }
 
+// misplaced reports the directs of body, which is nested in d, having one of
+// the types.
+func misplaced(d direct, body *sectionDirect, typeList ...reflect.Type) error {
+	if body == nil {
+		return nil
+	}
+	var errs ErrorList
+	for _, v := range body.list {
+		if isType(v, typeList...) {
+			errs.add(misplacedError(v, d))
+		}
+	}
+
+	return errs.err()
+}
+
+// strayJumps reports the break and continue directs of body, which is nested
+// in d, being outside of a for loop.
+func strayJumps(d direct, body *sectionDirect) error {
+	if body == nil {
+		return nil
+	}
+	var errs ErrorList
+	for _, v := range body.list {
+		switch v := v.(type) {
+		case *breakDirect, *continueDirect:
+			errs.add(misplacedError(v, d))
+		case *sectionDirect:
+			errs.add(strayJumps(d, v))
+		case *ifDirect:
+			errs.add(strayJumps(v, v.body))
+			if v.el != nil {
+				errs.add(strayJumps(v, &sectionDirect{list: []direct{v.el}}))
+			}
+		case *forDirect:
+			// the body is in the loop, but not its else branch
+			errs.add(strayJumps(v, v.el))
+		case *blockDirect:
+			errs.add(strayJumps(v, v.body))
+		case *autoescapeDirect:
+			errs.add(strayJumps(v, v.body))
+		case *macroDirect:
+			errs.add(strayJumps(v, v.body))
+		}
+	}
+
+	return errs.err()
+}
+
+func misplacedError(x, in direct) error {
+	return newSyntaxError(CodeMisplaced, directPos(x), "unexpected %s in %s", x.typ(), in.typ())
+}
+
+// directPos returns the first token of d; or nil.
+func directPos(d direct) *token {
+	switch d := d.(type) {
+	case *textDirect:
+		return d.text.value
+	case *valueDirect:
+		return d.tok.pos()
+	case *assignDirect:
+		return d.lh.name
+	case *sectionDirect:
+		if len(d.list) > 0 {
+			return directPos(d.list[0])
+		}
+	case *ifDirect:
+		return d.cond.pos()
+	case *forDirect:
+		return d.value.name
+	case *breakDirect:
+		return d.tok
+	case *continueDirect:
+		return d.tok
+	case *blockDirect:
+		return d.name.value
+	case *includeDirect:
+		return d.path.value
+	case *extendDirect:
+		return d.path.value
+	case *autoescapeDirect:
+		return d.strategy
+	case *macroDirect:
+		return d.name
+	case *importDirect:
+		return d.path.value
+	case *fromDirect:
+		return d.path.value
+	}
+
+	return nil
+}
+
 func exprValidateError(e expr) error {
-	return errors.Errorf("parse expr failed: %s", e.literal())
+	return newSyntaxError(CodeInvalidExpr, e.pos(), "parse expr failed: %s", e.literal())
 }